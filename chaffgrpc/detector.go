@@ -0,0 +1,58 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaffgrpc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mikehelmick/go-chaff"
+	"google.golang.org/grpc/metadata"
+)
+
+// Detector determines if an incoming call is chaff.
+type Detector interface {
+	IsChaff(ctx context.Context, method string) bool
+}
+
+var _ Detector = (DetectorFunc)(nil)
+
+type DetectorFunc func(ctx context.Context, method string) bool
+
+func (d DetectorFunc) IsChaff(ctx context.Context, method string) bool {
+	return d(ctx, method)
+}
+
+// MetadataDetector is a detector that searches for the metadata key's presence
+// in the incoming metadata to mark a call as chaff. It is the gRPC equivalent
+// of chaff.HeaderDetector. If key is empty, the lowercase chaff.Header is used.
+func MetadataDetector(key string) Detector {
+	if key == "" {
+		key = chaff.Header
+	}
+	key = strings.ToLower(key)
+	return DetectorFunc(func(ctx context.Context, method string) bool {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return false
+		}
+		for _, v := range md.Get(key) {
+			if v != "" {
+				return true
+			}
+		}
+		return false
+	})
+}
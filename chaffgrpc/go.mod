@@ -0,0 +1,23 @@
+module github.com/mikehelmick/go-chaff/chaffgrpc
+
+go 1.14
+
+require (
+	github.com/golang/protobuf v1.5.3
+	github.com/mikehelmick/go-chaff v0.3.0
+	github.com/mikehelmick/go-chaff/chaffproto v0.1.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/grpc v1.54.0
+	google.golang.org/protobuf v1.30.0
+)
+
+// Develop against the modules in this repository. Replace directives only apply
+// here, importers use the required releases, which must be tagged before this
+// module.
+replace (
+	github.com/mikehelmick/go-chaff => ../
+	github.com/mikehelmick/go-chaff/chaffproto => ../chaffproto
+)
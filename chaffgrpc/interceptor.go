@@ -0,0 +1,248 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaffgrpc provides gRPC server interceptors that track real calls
+// and answer chaff calls, like chaff.Tracker does for http handlers.
+package chaffgrpc
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikehelmick/go-chaff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type config struct {
+	responseType ResponseTypeFunc
+	paddingField string
+}
+
+// Option configures the interceptors.
+type Option func(*config)
+
+// WithResponseType sets the function that creates the response message of a
+// chaff call. By default, the output type of the method is looked up in the
+// global protobuf registry, which works for all generated services.
+func WithResponseType(fn ResponseTypeFunc) Option {
+	return func(c *config) {
+		c.responseType = fn
+	}
+}
+
+// WithPaddingField sets the name of a singular bytes or string field that
+// carries the padding of chaff responses, like chaffproto.Responder does.
+//
+// Responses whose type doesn't have this field are padded with an unknown
+// field instead. Real responses never carry that field, so anyone who can
+// decode the messages can tell these chaff responses apart. Declare a padding
+// field in all response messages if that matters.
+func WithPaddingField(name string) Option {
+	return func(c *config) {
+		c.paddingField = name
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{responseType: registryResponseType}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// UnaryServerInterceptor is the gRPC equivalent of Tracker.HandleTrack. Real
+// calls are recorded per full method name. If the call is deemed to be chaff
+// (as determined by the Detector), a response of the method's output type is
+// sent, padded to the size of real responses after the latency of real calls.
+// The header metadata of real responses is mimicked like http headers.
+//
+// Calls that return an error are not recorded.
+func UnaryServerInterceptor(t *chaff.Tracker, d Detector, opts ...Option) grpc.UnaryServerInterceptor {
+	c := newConfig(opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		if d != nil && d.IsChaff(ctx, info.FullMethod) {
+			return c.chaffUnary(ctx, t, info.FullMethod, start)
+		}
+
+		stream := &headerStream{ServerTransportStream: grpc.ServerTransportStreamFromContext(ctx)}
+		if stream.ServerTransportStream != nil {
+			ctx = grpc.NewContextWithServerTransportStream(ctx, stream)
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		t.Record(chaff.Observation{
+			Key:               info.FullMethod,
+			Latency:           time.Since(start),
+			Header:            stream.Header(),
+			BodySize:          messageSize(resp),
+			RequestHeaderSize: metadataSize(md),
+			RequestBodySize:   messageSize(req),
+		})
+		return resp, nil
+	}
+}
+
+func (c *config) chaffUnary(ctx context.Context, t *chaff.Tracker, method string, start time.Time) (interface{}, error) {
+	p := t.KeyProfile(method)
+	resp, err := c.response(method, p.BodySize)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(p.Header) > 0 {
+		grpc.SetHeader(ctx, toMetadata(p.Header))
+	}
+	t.Wait(ctx, start, p.Latency)
+	return resp, nil
+}
+
+// StreamServerInterceptor is the streaming equivalent of
+// UnaryServerInterceptor. The sizes of all messages of a real call are added
+// up. A chaff call reads the client's messages and answers with a single
+// message of the total size.
+//
+// Calls that return an error are not recorded.
+func StreamServerInterceptor(t *chaff.Tracker, d Detector, opts ...Option) grpc.StreamServerInterceptor {
+	c := newConfig(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		if d != nil && d.IsChaff(ss.Context(), info.FullMethod) {
+			return c.chaffStream(ss, t, info, start)
+		}
+
+		stream := &trackedStream{ServerStream: ss}
+		if err := handler(srv, stream); err != nil {
+			return err
+		}
+
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		t.Record(chaff.Observation{
+			Key:               info.FullMethod,
+			Latency:           time.Since(start),
+			Header:            stream.Header(),
+			BodySize:          atomic.LoadUint64(&stream.sent),
+			RequestHeaderSize: metadataSize(md),
+			RequestBodySize:   atomic.LoadUint64(&stream.received),
+		})
+		return nil
+	}
+}
+
+func (c *config) chaffStream(ss grpc.ServerStream, t *chaff.Tracker, info *grpc.StreamServerInfo, start time.Time) error {
+	// Consume the request like the real handler would. Every message can be
+	// decoded as Empty, its fields are kept as unknown fields.
+	for {
+		err := ss.RecvMsg(&emptypb.Empty{})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsClientStream {
+			break
+		}
+	}
+
+	p := t.KeyProfile(info.FullMethod)
+	resp, err := c.response(info.FullMethod, p.BodySize)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if len(p.Header) > 0 {
+		ss.SetHeader(toMetadata(p.Header))
+	}
+	t.Wait(ss.Context(), start, p.Latency)
+	return ss.SendMsg(resp)
+}
+
+// headerMetadata collects the header metadata set by a handler.
+type headerMetadata struct {
+	mu     sync.Mutex
+	header metadata.MD
+}
+
+func (h *headerMetadata) add(md metadata.MD) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header = metadata.Join(h.header, md)
+}
+
+// Header returns the collected metadata as a header, for recording.
+func (h *headerMetadata) Header() http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return toHeader(h.header)
+}
+
+// headerStream collects the header metadata set by a unary handler.
+type headerStream struct {
+	grpc.ServerTransportStream
+	headerMetadata
+}
+
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.add(md)
+	return s.ServerTransportStream.SetHeader(md)
+}
+
+func (s *headerStream) SendHeader(md metadata.MD) error {
+	s.add(md)
+	return s.ServerTransportStream.SendHeader(md)
+}
+
+// trackedStream collects the header metadata and counts the message sizes of
+// a streaming call.
+type trackedStream struct {
+	grpc.ServerStream
+	headerMetadata
+	sent     uint64
+	received uint64
+}
+
+func (s *trackedStream) SetHeader(md metadata.MD) error {
+	s.add(md)
+	return s.ServerStream.SetHeader(md)
+}
+
+func (s *trackedStream) SendHeader(md metadata.MD) error {
+	s.add(md)
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *trackedStream) SendMsg(m interface{}) error {
+	atomic.AddUint64(&s.sent, messageSize(m))
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *trackedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddUint64(&s.received, messageSize(m))
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaffgrpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mikehelmick/go-chaff"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	unaryMethod  = "/grpc.testing.TestService/UnaryCall"
+	streamMethod = "/grpc.testing.TestService/StreamingInputCall"
+)
+
+type testServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (s *testServer) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	grpc.SetHeader(ctx, metadata.Pairs("x-real", "header-value"))
+	time.Sleep(20 * time.Millisecond)
+	return &testpb.SimpleResponse{
+		Payload: &testpb.Payload{Body: make([]byte, req.ResponseSize)},
+	}, nil
+}
+
+func (s *testServer) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	var size int32
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{AggregatedPayloadSize: size})
+		}
+		if err != nil {
+			return err
+		}
+		size += int32(len(req.Payload.GetBody()))
+	}
+}
+
+func newClient(t *testing.T, track *chaff.Tracker, opts ...Option) testpb.TestServiceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	d := MetadataDetector("")
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(track, d, opts...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(track, d, opts...)))
+	testpb.RegisterTestServiceServer(srv, &testServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return testpb.NewTestServiceClient(conn)
+}
+
+// waitForProfile waits until real calls of the method are recorded.
+func waitForProfile(t *testing.T, track *chaff.Tracker, method string) chaff.Profile {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := track.KeyProfile(method); p.BodySize > 0 {
+			return p
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no calls recorded for %v", method)
+	return chaff.Profile{}
+}
+
+func chaffContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-chaff", "1")
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	track := chaff.New()
+	defer track.Close()
+	client := newClient(t, track, WithPaddingField("username"))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{ResponseSize: 500}); err != nil {
+			t.Fatalf("UnaryCall: %v", err)
+		}
+	}
+	want := waitForProfile(t, track, unaryMethod)
+	if want.Latency < 20*time.Millisecond {
+		t.Errorf("recorded latency: got %v, want >= 20ms", want.Latency)
+	}
+	if want.HeaderSize == 0 {
+		t.Errorf("recorded header size: got 0, want > 0")
+	}
+
+	var header metadata.MD
+	start := time.Now()
+	resp, err := client.UnaryCall(chaffContext(ctx), &testpb.SimpleRequest{}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("chaff UnaryCall: %v", err)
+	}
+	if got := time.Since(start); got < want.Latency {
+		t.Errorf("chaff latency: got %v, want >= %v", got, want.Latency)
+	}
+	if got := uint64(proto.Size(resp)); got != want.BodySize {
+		t.Errorf("chaff response size: got %v, want %v", got, want.BodySize)
+	}
+	// The padding is in a declared field, not in unknown fields.
+	if resp.Username == "" || len(proto.MessageV2(resp).ProtoReflect().GetUnknown()) > 0 {
+		t.Errorf("chaff response not padded through the padding field: %v", resp)
+	}
+
+	// The real header metadata is mimicked, without a chaff specific key.
+	if got := header.Get("x-chaff"); len(got) != 0 {
+		t.Errorf("chaff response has x-chaff metadata: %v", got)
+	}
+	if got := header.Get("x-real"); len(got) != 1 || len(got[0]) != len("header-value") {
+		t.Errorf("chaff response x-real metadata: got %v", got)
+	}
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	track := chaff.New()
+	defer track.Close()
+	client := newClient(t, track)
+	ctx := context.Background()
+
+	send := func(ctx context.Context) (*testpb.StreamingInputCallResponse, error) {
+		stream, err := client.StreamingInputCall(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < 3; i++ {
+			if err := stream.Send(&testpb.StreamingInputCallRequest{
+				Payload: &testpb.Payload{Body: make([]byte, 100)},
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return stream.CloseAndRecv()
+	}
+
+	if _, err := send(ctx); err != nil {
+		t.Fatalf("StreamingInputCall: %v", err)
+	}
+	want := waitForProfile(t, track, streamMethod)
+	if got := track.RequestProfile().BodySize; got < 300 {
+		t.Errorf("recorded request size: got %v, want >= 300", got)
+	}
+
+	resp, err := send(chaffContext(ctx))
+	if err != nil {
+		t.Fatalf("chaff StreamingInputCall: %v", err)
+	}
+	// The real response is too small to be padded, the chaff response is
+	// empty.
+	if got := uint64(proto.Size(resp)); got > want.BodySize {
+		t.Errorf("chaff response size: got %v, want <= %v", got, want.BodySize)
+	}
+}
+
+func TestMetadataDetector(t *testing.T) {
+	cases := []struct {
+		name string
+		md   metadata.MD
+		want bool
+	}{
+		{"none", nil, false},
+		{"other", metadata.Pairs("x-other", "1"), false},
+		{"empty", metadata.Pairs("x-chaff", ""), false},
+		{"present", metadata.Pairs("x-chaff", "1"), true},
+	}
+
+	d := MetadataDetector("")
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tc.md)
+			}
+			if got := d.IsChaff(ctx, unaryMethod); got != tc.want {
+				t.Errorf("IsChaff: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPadUnknown(t *testing.T) {
+	for _, size := range []int{0, 5, 6, 7, 100, 133, 134, 135, 10000} {
+		m := &emptypb.Empty{}
+		padUnknown(m.ProtoReflect(), size)
+		got := proto.Size(m)
+		if got > size || (size >= 6 && size-got > 1) {
+			t.Errorf("pad(%v): got size %v", size, got)
+		}
+	}
+}
+
+func TestRegistryResponseType(t *testing.T) {
+	c := newConfig(nil)
+	resp, err := c.response(unaryMethod, 100)
+	if err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	if _, ok := resp.(*testpb.SimpleResponse); !ok {
+		t.Errorf("response type: got %T, want *grpc_testing.SimpleResponse", resp)
+	}
+
+	if _, err := c.response("/unknown.Service/Method", 100); err == nil {
+		t.Errorf("response for unknown method: want error")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaffgrpc
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	protov1 "github.com/golang/protobuf/proto"
+	"github.com/mikehelmick/go-chaff/chaffproto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// unknownField is the field number of the unknown field that carries the
+// padding of chaff responses without a padding field. It is the largest valid
+// field number, so it doesn't collide with the fields of real messages.
+const unknownField = protowire.MaxValidNumber
+
+// ResponseTypeFunc returns a new, empty response message for the given full
+// method name, e.g. "/package.Service/Method".
+type ResponseTypeFunc func(method string) proto.Message
+
+// messageSize returns the marshalled size of a protobuf message, or zero if
+// v isn't a protobuf message.
+func messageSize(v interface{}) uint64 {
+	switch m := v.(type) {
+	case proto.Message:
+		return uint64(proto.Size(m))
+	case protov1.Message:
+		return uint64(proto.Size(protov1.MessageV2(m)))
+	}
+	return 0
+}
+
+// metadataSize returns the size of the metadata, counted like chaff headers:
+// the length of each key plus the length of its values.
+func metadataSize(md metadata.MD) uint64 {
+	var size uint64
+	for k, vals := range md {
+		size += uint64(len(k))
+		for _, v := range vals {
+			size += uint64(len(v))
+		}
+	}
+	return size
+}
+
+// toHeader converts metadata to a header, for recording.
+func toHeader(md metadata.MD) http.Header {
+	h := make(http.Header, len(md))
+	for k, vals := range md {
+		h[http.CanonicalHeaderKey(k)] = append([]string(nil), vals...)
+	}
+	return h
+}
+
+// toMetadata converts a header to metadata, whose keys are lowercase.
+func toMetadata(h http.Header) metadata.MD {
+	md := make(metadata.MD, len(h))
+	for k, vals := range h {
+		md[strings.ToLower(k)] = vals
+	}
+	return md
+}
+
+// registryResponseType looks up the output type of the method in the global
+// protobuf registries.
+func registryResponseType(method string) proto.Message {
+	service, name, ok := splitMethod(method)
+	if !ok {
+		return nil
+	}
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil
+	}
+	return mt.New().Interface()
+}
+
+// splitMethod splits "/package.Service/Method" into its service and method.
+func splitMethod(method string) (string, string, bool) {
+	method = strings.TrimPrefix(method, "/")
+	i := strings.LastIndex(method, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	return method[:i], method[i+1:], true
+}
+
+// response returns a message of the given type that is padded to size. The
+// message is returned as the generated type, so that it can be marshalled by
+// the gRPC codec.
+func (c *config) response(method string, size uint64) (interface{}, error) {
+	m := c.responseType(method)
+	if m == nil {
+		return nil, fmt.Errorf("unknown response type for %q", method)
+	}
+	if c.paddingField == "" || chaffproto.Pad(m, c.paddingField, size) != nil {
+		padUnknown(m.ProtoReflect(), int(size))
+	}
+	return protov1.MessageV1(m), nil
+}
+
+// padUnknown adds an unknown bytes field to the message so that its marshalled
+// size is close to size. Sizes that are too small to fit a field are not
+// padded.
+func padUnknown(m protoreflect.Message, size int) {
+	n := size - proto.Size(m.Interface())
+	tag := protowire.SizeTag(unknownField)
+	k := n - tag - 1
+	for k >= 0 && tag+protowire.SizeBytes(k) > n {
+		k--
+	}
+	if k < 0 {
+		return
+	}
+
+	b := make([]byte, k)
+	rand.Read(b)
+	unknown := protowire.AppendTag(m.GetUnknown(), unknownField, protowire.BytesType)
+	m.SetUnknown(protowire.AppendBytes(unknown, b))
+}
@@ -0,0 +1,13 @@
+module github.com/mikehelmick/go-chaff/chaffproto
+
+go 1.14
+
+require (
+	github.com/mikehelmick/go-chaff v0.3.0
+	google.golang.org/protobuf v1.25.0
+)
+
+// Develop against the root module in this repository. Replace directives only
+// apply here, importers use the required release, which must be tagged before
+// this module.
+replace github.com/mikehelmick/go-chaff => ../
@@ -0,0 +1,173 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaffproto provides a chaff responder for protobuf APIs.
+package chaffproto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/mikehelmick/go-chaff"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// ContentType is the Content-Type of protobuf chaff responses.
+	ContentType = "application/x-protobuf"
+
+	// Number of bytes added by the content type header for protobuf.
+	contentHeaderSize = uint64(len("Content-Type") + len(ContentType))
+)
+
+// ProduceFn is a function for producing protobuf responses. It must return a
+// new message, which may have fields other than the padding field already set.
+type ProduceFn func() proto.Message
+
+// Responder implements the chaff.Responder interface and allows you to reply
+// to chaff requests with a protobuf message. A designated bytes or string
+// field is filled with padding, so that the marshalled message matches the
+// size of real responses.
+type Responder struct {
+	fn    ProduceFn
+	field protoreflect.Name
+}
+
+// NewResponder creates a new protobuf responder. The field must be the name of
+// a singular bytes or string field of the message returned by fn.
+func NewResponder(fn ProduceFn, field string) (chaff.Responder, error) {
+	if fn == nil {
+		return nil, fmt.Errorf("fn must be non-nil")
+	}
+
+	fd, err := paddingField(fn().ProtoReflect().Descriptor(), field)
+	if err != nil {
+		return nil, err
+	}
+	return &Responder{
+		fn:    fn,
+		field: fd.Name(),
+	}, nil
+}
+
+// Pad fills the given field of msg with padding, so that the marshalled size of
+// msg is close to size. The field must be the name of a singular bytes or string
+// field. Very small sizes can't be matched exactly.
+func Pad(msg proto.Message, field string, size uint64) error {
+	m := msg.ProtoReflect()
+	fd, err := paddingField(m.Descriptor(), field)
+	if err != nil {
+		return err
+	}
+	pad(m, fd, size)
+	return nil
+}
+
+func paddingField(md protoreflect.MessageDescriptor, field string) (protoreflect.FieldDescriptor, error) {
+	fd := md.Fields().ByName(protoreflect.Name(field))
+	if fd == nil {
+		return nil, fmt.Errorf("message has no field %q", field)
+	}
+	if fd.Cardinality() == protoreflect.Repeated || (fd.Kind() != protoreflect.BytesKind && fd.Kind() != protoreflect.StringKind) {
+		return nil, fmt.Errorf("field %q must be a singular bytes or string field", field)
+	}
+	return fd, nil
+}
+
+func (p *Responder) Write(statusCode int, headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
+	var bodyData []byte
+	if bodySize > 0 && chaff.BodyAllowedForStatus(statusCode) {
+		var err error
+		if bodyData, err = p.marshal(bodySize); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+	}
+
+	// Headers must be set before WriteHeader, otherwise they are dropped. Keep
+	// the Content-Type of real responses, if the tracker mimicked it.
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", ContentType)
+		if headerSize > contentHeaderSize {
+			headerSize -= contentHeaderSize
+		} else {
+			headerSize = 0
+		}
+	}
+	chaff.PadHeaders(w, r, headerSize)
+	w.WriteHeader(statusCode)
+	_, err := w.Write(bodyData)
+	return err
+}
+
+// marshal produces a message whose marshalled size is close to size.
+func (p *Responder) marshal(size uint64) ([]byte, error) {
+	msg := p.fn().ProtoReflect()
+	pad(msg, msg.Descriptor().Fields().ByName(p.field), size)
+	return proto.Marshal(msg.Interface())
+}
+
+func pad(msg protoreflect.Message, fd protoreflect.FieldDescriptor, size uint64) {
+	// The field adds a tag and a length prefix to the padding. Start without
+	// any overhead and correct by the difference.
+	padding := int(size) - proto.Size(msg.Interface())
+	best, bestDiff := 0, int(size)
+	for i := 0; i < 3; i++ {
+		if padding < 0 {
+			padding = 0
+		}
+		msg.Set(fd, paddingValue(fd, padding))
+		diff := int(size) - proto.Size(msg.Interface())
+		if diff == 0 {
+			return
+		}
+		if abs(diff) < abs(bestDiff) {
+			best, bestDiff = padding, diff
+		}
+		padding += diff
+	}
+	// Very small sizes can't be matched exactly.
+	msg.Set(fd, paddingValue(fd, best))
+}
+
+func paddingValue(fd protoreflect.FieldDescriptor, n int) protoreflect.Value {
+	if fd.Kind() == protoreflect.StringKind {
+		return protoreflect.ValueOfString(randomString(n))
+	}
+	b := make([]byte, n)
+	rand.Read(b)
+	return protoreflect.ValueOfBytes(b)
+}
+
+// randomString generates exactly n characters of random, printable data.
+func randomString(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	b := make([]byte, base64.RawURLEncoding.DecodedLen(n)+1)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n]
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
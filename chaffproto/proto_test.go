@@ -0,0 +1,121 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaffproto
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestResponder(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		fn   ProduceFn
+	}{
+		{"bytes", func() proto.Message { return &wrapperspb.BytesValue{} }},
+		{"string", func() proto.Message { return &wrapperspb.StringValue{} }},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			responder, err := NewResponder(tc.fn, "value")
+			if err != nil {
+				t.Fatalf("NewResponder: %v", err)
+			}
+
+			// The smallest message with padding is 3 bytes.
+			for _, size := range []uint64{3, 100, 127, 128, 129, 5000, 100000} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/", nil)
+				if err := responder.Write(http.StatusOK, 100, size, w, r); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+
+				if got := w.Header().Get("Content-Type"); got != ContentType {
+					t.Errorf("wrong Content-Type, want: %q, got: %q", ContentType, got)
+				}
+				if got := w.Body.Len(); uint64(got) != size {
+					t.Errorf("wrong body size, want: %d, got: %d", size, got)
+				}
+				msg := tc.fn()
+				if err := proto.Unmarshal(w.Body.Bytes(), msg); err != nil {
+					t.Errorf("invalid message: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestResponderKeepsContentType(t *testing.T) {
+	t.Parallel()
+
+	responder, err := NewResponder(func() proto.Message { return &wrapperspb.BytesValue{} }, "value")
+	if err != nil {
+		t.Fatalf("NewResponder: %v", err)
+	}
+
+	// The tracker copies the Content-Type of real responses before the
+	// responder writes.
+	const contentType = "application/protobuf; proto=example.v1.User"
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", contentType)
+	if err := responder.Write(http.StatusOK, 0, 100, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := w.Header().Get("Content-Type"); got != contentType {
+		t.Errorf("wrong Content-Type, want: %q, got: %q", contentType, got)
+	}
+}
+
+func TestNewResponderErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewResponder(nil, "value"); err == nil {
+		t.Errorf("expected error for nil fn")
+	}
+
+	duration := func() proto.Message { return &durationpb.Duration{} }
+	for _, field := range []string{"missing", "seconds"} {
+		if _, err := NewResponder(duration, field); err == nil {
+			t.Errorf("expected error for field %q", field)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	t.Parallel()
+
+	msg := &wrapperspb.StringValue{}
+	if err := Pad(msg, "value", 1000); err != nil {
+		t.Fatalf("Pad: %v", err)
+	}
+	if got := proto.Size(msg); got != 1000 {
+		t.Errorf("wrong size, want: 1000, got: %d", got)
+	}
+
+	if err := Pad(&durationpb.Duration{}, "seconds", 1000); err == nil {
+		t.Errorf("expected error for non-bytes field")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client provides a scheduler for sending chaff requests from http
+// clients.
+//
+// Chaff requests are marked with the chaff.Header header so that servers using
+// chaff.HeaderDetector answer them with a chaff response. To hide when real
+// requests are being sent, the scheduler sends chaff requests at random
+// intervals and pads their bodies to look like real requests.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mikehelmick/go-chaff"
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+// IntervalFunc returns the time to wait before sending the next chaff request.
+type IntervalFunc func() time.Duration
+
+// Poisson returns intervals that are exponentially distributed with the given
+// mean, i.e. chaff requests are sent as a Poisson process.
+func Poisson(mean time.Duration) IntervalFunc {
+	return func() time.Duration {
+		// 1 - random.Float() is in (0, 1], avoiding log(0).
+		return time.Duration(-math.Log(1-random.Float()) * float64(mean))
+	}
+}
+
+// Jittered returns intervals that are uniformly distributed in
+// [base - jitter, base + jitter].
+func Jittered(base, jitter time.Duration) IntervalFunc {
+	return func() time.Duration {
+		d := base - jitter + time.Duration(random.Float()*float64(2*jitter))
+		if d < 0 {
+			d = 0
+		}
+		return d
+	}
+}
+
+// SizeFunc returns the size of the body for the next chaff request.
+type SizeFunc func() uint64
+
+// FixedSize pads every chaff request body to size bytes.
+func FixedSize(size uint64) SizeFunc {
+	return func() uint64 {
+		return size
+	}
+}
+
+// SampleSizes pads chaff request bodies to a size randomly selected from the
+// given sizes, e.g. the sizes of recent real requests.
+func SampleSizes(sizes ...uint64) SizeFunc {
+	return func() uint64 {
+		if len(sizes) == 0 {
+			return 0
+		}
+		return sizes[random.Index(len(sizes))]
+	}
+}
+
+// Scheduler periodically sends chaff requests to a single URL.
+type Scheduler struct {
+	client      *http.Client
+	url         string
+	method      string
+	header      string
+	contentType string
+	interval    IntervalFunc
+	size        SizeFunc
+	tokenKey    []byte
+}
+
+// Option defines a method for applying options when configuring a new
+// scheduler.
+type Option func(*Scheduler)
+
+// WithMethod sets the HTTP method of chaff requests. The default is POST.
+func WithMethod(method string) Option {
+	return func(s *Scheduler) {
+		s.method = method
+	}
+}
+
+// WithHeader sets the header that marks a request as chaff. The default is
+// chaff.Header.
+func WithHeader(h string) Option {
+	return func(s *Scheduler) {
+		s.header = h
+	}
+}
+
+// WithToken marks chaff requests with a token minted from key using
+// chaff.MintToken instead of a fixed header value, for servers using
+// chaff.HMACDetector with the same key.
+func WithToken(key []byte) Option {
+	return func(s *Scheduler) {
+		s.tokenKey = key
+	}
+}
+
+// WithContentType sets the Content-Type of chaff requests with a body.
+func WithContentType(ct string) Option {
+	return func(s *Scheduler) {
+		s.contentType = ct
+	}
+}
+
+// WithInterval sets the intervals between chaff requests. The default is a
+// Poisson process with a mean of one minute.
+func WithInterval(fn IntervalFunc) Option {
+	return func(s *Scheduler) {
+		s.interval = fn
+	}
+}
+
+// WithBodySize sets the size of chaff request bodies. By default requests have
+// no body.
+func WithBodySize(fn SizeFunc) Option {
+	return func(s *Scheduler) {
+		s.size = fn
+	}
+}
+
+// NewScheduler creates a scheduler that sends chaff requests to url using the
+// given client. Use Run to start sending requests.
+func NewScheduler(c *http.Client, url string, opts ...Option) (*Scheduler, error) {
+	if c == nil {
+		return nil, fmt.Errorf("client must be non-nil")
+	}
+	if url == "" {
+		return nil, fmt.Errorf("url must be non-empty")
+	}
+
+	s := &Scheduler{
+		client:   c,
+		url:      url,
+		method:   http.MethodPost,
+		header:   chaff.Header,
+		interval: Poisson(time.Minute),
+		size:     FixedSize(0),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Run sends chaff requests until the context is cancelled, then returns the
+// context's error. Failed chaff requests are logged and do not stop the
+// scheduler.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		timer := time.NewTimer(s.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if err := s.Send(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error sending chaff request: %v", err)
+		}
+	}
+}
+
+// Send sends a single chaff request and discards the response.
+func (s *Scheduler) Send(ctx context.Context) error {
+	var body io.Reader
+	if size := s.size(); size > 0 {
+		body = strings.NewReader(chaff.RandomData(size))
+	}
+
+	req, err := http.NewRequest(s.method, s.url, body)
+	if err != nil {
+		return fmt.Errorf("creating chaff request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	value := "1"
+	if s.tokenKey != nil {
+		if value, err = chaff.MintToken(s.tokenKey, time.Now()); err != nil {
+			return fmt.Errorf("minting chaff token: %w", err)
+		}
+	}
+	req.Header.Set(s.header, value)
+	if body != nil && s.contentType != "" {
+		req.Header.Set("Content-Type", s.contentType)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending chaff request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read the whole response so timing matches a real request.
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return fmt.Errorf("reading chaff response: %w", err)
+	}
+	return nil
+}
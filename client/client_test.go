@@ -0,0 +1,192 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikehelmick/go-chaff"
+)
+
+func TestScheduler(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var sizes []int
+	realCount := 0
+
+	tracker := chaff.New()
+	defer tracker.Close()
+
+	handler := tracker.HandleTrack(chaff.HeaderDetector(chaff.Header),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			realCount++
+		}))
+
+	// Observe chaff requests before they reach the tracker.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(chaff.Header) == "" {
+			t.Errorf("chaff request is missing %s header", chaff.Header)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading body: %v", err)
+		}
+		mu.Lock()
+		sizes = append(sizes, len(b))
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	s, err := NewScheduler(srv.Client(), srv.URL,
+		WithInterval(Poisson(5*time.Millisecond)),
+		WithBodySize(FixedSize(400)))
+	if err != nil {
+		t.Fatalf("NewScheduler: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error from Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("scheduler did not stop on context cancellation")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) == 0 {
+		t.Fatalf("no chaff requests were sent")
+	}
+	if realCount != 0 {
+		t.Errorf("chaff requests reached the real handler %d times", realCount)
+	}
+	for _, size := range sizes {
+		if size < 396 || size > 404 {
+			t.Errorf("chaff body not padded to 400 bytes, got: %d", size)
+		}
+	}
+}
+
+func TestSchedulerToken(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("secret")
+	detector, err := chaff.NewHMACDetector(chaff.Header, time.Minute, key)
+	if err != nil {
+		t.Fatalf("NewHMACDetector: %v", err)
+	}
+
+	tracker := chaff.New()
+	defer tracker.Close()
+
+	realCount := 0
+	srv := httptest.NewServer(tracker.HandleTrack(detector,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			realCount++
+		})))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		key  []byte
+		real int
+	}{
+		{key: key, real: 0},
+		{key: []byte("other"), real: 1},
+	} {
+		s, err := NewScheduler(srv.Client(), srv.URL, WithToken(tc.key))
+		if err != nil {
+			t.Fatalf("NewScheduler: %v", err)
+		}
+		realCount = 0
+		if err := s.Send(context.Background()); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if realCount != tc.real {
+			t.Errorf("real handler called %d times, want %d", realCount, tc.real)
+		}
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewScheduler(nil, "http://example.com"); err == nil {
+		t.Errorf("expected error for nil client")
+	}
+	if _, err := NewScheduler(http.DefaultClient, ""); err == nil {
+		t.Errorf("expected error for empty url")
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	t.Parallel()
+
+	const n = 10000
+	var total time.Duration
+	poisson := Poisson(100 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		d := poisson()
+		if d < 0 {
+			t.Fatalf("negative interval: %v", d)
+		}
+		total += d
+	}
+	if mean := total / n; mean < 90*time.Millisecond || mean > 110*time.Millisecond {
+		t.Errorf("poisson mean not within 10%% of 100ms, got: %v", mean)
+	}
+
+	jittered := Jittered(100*time.Millisecond, 20*time.Millisecond)
+	for i := 0; i < n; i++ {
+		if d := jittered(); d < 80*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("jittered interval out of range: %v", d)
+		}
+	}
+}
+
+func TestSampleSizes(t *testing.T) {
+	t.Parallel()
+
+	fn := SampleSizes(10, 20, 30)
+	seen := make(map[uint64]bool)
+	for i := 0; i < 200; i++ {
+		seen[fn()] = true
+	}
+	if len(seen) != 3 || !seen[10] || !seen[20] || !seen[30] {
+		t.Errorf("expected all sizes to be sampled, got: %v", seen)
+	}
+	if got := SampleSizes()(); got != 0 {
+		t.Errorf("expected 0 for no sizes, got: %d", got)
+	}
+}
@@ -15,14 +15,24 @@
 
 package chaff
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
 
+// Detector decides whether a request is chaff.
 type Detector interface {
 	IsChaff(r *http.Request) bool
 }
 
 var _ Detector = (DetectorFunc)(nil)
 
+// DetectorFunc adapts a function to the Detector interface.
 type DetectorFunc func(r *http.Request) bool
 
 func (d DetectorFunc) IsChaff(r *http.Request) bool {
@@ -32,7 +42,205 @@ func (d DetectorFunc) IsChaff(r *http.Request) bool {
 // HeaderDetector is a detector that searches for the header's presence to mark
 // a request as chaff.
 func HeaderDetector(h string) Detector {
+	return headerDetector(h)
+}
+
+type headerDetector string
+
+func (d headerDetector) IsChaff(r *http.Request) bool {
+	return r.Header.Get(string(d)) != ""
+}
+
+func (d headerDetector) StripMarker(r *http.Request) {
+	r.Header.Del(string(d))
+}
+
+// QueryDetector is a detector that marks a request as chaff if the URL query
+// parameter is present and non-empty.
+func QueryDetector(param string) Detector {
+	return queryDetector(param)
+}
+
+type queryDetector string
+
+func (d queryDetector) IsChaff(r *http.Request) bool {
+	return r.URL.Query().Get(string(d)) != ""
+}
+
+// StripMarker removes the parameter from the raw query, leaving the order and
+// escaping of the other parameters as they were.
+func (d queryDetector) StripMarker(r *http.Request) {
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	kept := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		key := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key = pair[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil && k == string(d) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if len(kept) == len(pairs) {
+		return
+	}
+	r.URL.RawQuery = strings.Join(kept, "&")
+	if r.RequestURI != "" {
+		r.RequestURI = r.URL.RequestURI()
+	}
+}
+
+// CookieDetector is a detector that marks a request as chaff if it carries a
+// non-empty cookie with the given name.
+func CookieDetector(name string) Detector {
+	return cookieDetector(name)
+}
+
+type cookieDetector string
+
+func (d cookieDetector) IsChaff(r *http.Request) bool {
+	c, err := r.Cookie(string(d))
+	return err == nil && c.Value != ""
+}
+
+func (d cookieDetector) StripMarker(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != string(d) {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// PathDetector is a detector that marks a request as chaff if its URL path
+// matches one of the patterns, using the same syntax as MethodRouteKey.
+func PathDetector(patterns ...string) Detector {
+	routes := make([][]string, len(patterns))
+	for i, p := range patterns {
+		routes[i] = splitPath(p)
+	}
+	return DetectorFunc(func(r *http.Request) bool {
+		segments := splitPath(r.URL.Path)
+		for _, route := range routes {
+			if matchRoute(route, segments) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// JSONFieldDetector is a detector that marks a request as chaff if its JSON
+// body has a string field at the dot separated path, e.g. "meta.chaff", and
+// verify returns true for its value. If verify is nil, any non-empty value
+// marks the request as chaff. Use verify to decrypt or authenticate the
+// value, e.g. with HMACDetector.Verify.
+//
+// At most maxBytes of the body are buffered. Larger bodies are never chaff.
+// The body is restored, so the real handler can still read all of it.
+func JSONFieldDetector(path string, maxBytes int64, verify func(string) bool) Detector {
+	fields := strings.Split(path, ".")
+	return DetectorFunc(func(r *http.Request) bool {
+		if r.Body == nil || r.Body == http.NoBody {
+			return false
+		}
+		if r.ContentLength > maxBytes {
+			return false
+		}
+
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		r.Body = &restoredBody{
+			Reader: io.MultiReader(bytes.NewReader(b), r.Body),
+			Closer: r.Body,
+		}
+		if err != nil || int64(len(b)) > maxBytes {
+			return false
+		}
+
+		value, ok := jsonField(b, fields)
+		if !ok || value == "" {
+			return false
+		}
+		return verify == nil || verify(value)
+	})
+}
+
+// restoredBody replays the bytes a detector read ahead of the rest of the
+// original body.
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
+
+// jsonField returns the string at the path of object fields in the JSON
+// document.
+func jsonField(b []byte, fields []string) (string, bool) {
+	raw := json.RawMessage(b)
+	for _, f := range fields {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return "", false
+		}
+		var ok bool
+		if raw, ok = obj[f]; !ok {
+			return "", false
+		}
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// AnyOf is a detector that marks a request as chaff if any of the detectors
+// does. Detectors are consulted in order until one matches.
+func AnyOf(ds ...Detector) Detector {
+	return anyOf(ds)
+}
+
+type anyOf []Detector
+
+func (ds anyOf) IsChaff(r *http.Request) bool {
+	for _, d := range ds {
+		if d.IsChaff(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds anyOf) StripMarker(r *http.Request) {
+	stripMarkers(ds, r)
+}
+
+// AllOf is a detector that marks a request as chaff only if all of the
+// detectors do. Detectors are consulted in order until one doesn't match.
+// With no detectors, no request is chaff.
+func AllOf(ds ...Detector) Detector {
+	return allOf(ds)
+}
+
+type allOf []Detector
+
+func (ds allOf) IsChaff(r *http.Request) bool {
+	for _, d := range ds {
+		if !d.IsChaff(r) {
+			return false
+		}
+	}
+	return len(ds) > 0
+}
+
+func (ds allOf) StripMarker(r *http.Request) {
+	stripMarkers(ds, r)
+}
+
+// Not is a detector that inverts d.
+func Not(d Detector) Detector {
 	return DetectorFunc(func(r *http.Request) bool {
-		return r.Header.Get(h) != ""
+		return !d.IsChaff(r)
 	})
 }
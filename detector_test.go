@@ -0,0 +1,130 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectors(t *testing.T) {
+	t.Parallel()
+
+	yes := DetectorFunc(func(*http.Request) bool { return true })
+	no := DetectorFunc(func(*http.Request) bool { return false })
+
+	cases := []struct {
+		name   string
+		d      Detector
+		target string
+		cookie string
+		want   bool
+	}{
+		{"query present", QueryDetector("chaff"), "/?chaff=1", "", true},
+		{"query empty", QueryDetector("chaff"), "/?chaff=", "", false},
+		{"query missing", QueryDetector("chaff"), "/", "", false},
+		{"cookie present", CookieDetector("chaff"), "/", "chaff=1", true},
+		{"cookie missing", CookieDetector("chaff"), "/", "other=1", false},
+		{"path match", PathDetector("/chaff/*"), "/chaff/a/b", "", true},
+		{"path param", PathDetector("/users/{id}/chaff"), "/users/1/chaff", "", true},
+		{"path mismatch", PathDetector("/chaff/*"), "/users/1", "", false},
+		{"any of", AnyOf(no, yes), "/", "", true},
+		{"any of none", AnyOf(), "/", "", false},
+		{"all of", AllOf(yes, yes), "/", "", true},
+		{"all of mismatch", AllOf(yes, no), "/", "", false},
+		{"all of none", AllOf(), "/", "", false},
+		{"not", Not(no), "/", "", true},
+		{"combined", AllOf(QueryDetector("a"), Not(CookieDetector("b"))), "/?a=1", "b=1", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.cookie != "" {
+			r.Header.Set("Cookie", tc.cookie)
+		}
+		if got := tc.d.IsChaff(r); got != tc.want {
+			t.Errorf("%s: IsChaff() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestJSONFieldDetector(t *testing.T) {
+	t.Parallel()
+
+	verify := func(v string) bool { return v == "token" }
+
+	cases := []struct {
+		name string
+		body string
+		max  int64
+		want bool
+	}{
+		{"nested", `{"meta": {"chaff": "token"}, "data": 1}`, 100, true},
+		{"wrong value", `{"meta": {"chaff": "nope"}}`, 100, false},
+		{"not a string", `{"meta": {"chaff": 1}}`, 100, false},
+		{"missing", `{"meta": {}}`, 100, false},
+		{"not an object", `{"meta": []}`, 100, false},
+		{"invalid", `{"meta": `, 100, false},
+		{"too large", `{"meta": {"chaff": "token"}}`, 10, false},
+	}
+	for _, tc := range cases {
+		d := JSONFieldDetector("meta.chaff", tc.max, verify)
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+		if got := d.IsChaff(r); got != tc.want {
+			t.Errorf("%s: IsChaff() = %v, want %v", tc.name, got, tc.want)
+		}
+
+		// The handler must still see the whole body.
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("%s: reading body: %v", tc.name, err)
+		}
+		if string(b) != tc.body {
+			t.Errorf("%s: body not restored, got: %q", tc.name, b)
+		}
+	}
+}
+
+func TestQueryDetectorStripMarker(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"chaff=1", ""},
+		{"b=2&a=1&chaff=1", "b=2&a=1"},
+		{"b=2&chaff=1&a=%2f1+2", "b=2&a=%2f1+2"},
+		{"ch%61ff=1&b=2", "b=2"},
+		{"b=2&chaff&chaff=1", "b=2"},
+		{"b=2&chaffx=1", "b=2&chaffx=1"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/api?"+tc.query, nil)
+		QueryDetector("chaff").(MarkerStripper).StripMarker(r)
+		if got := r.URL.RawQuery; got != tc.want {
+			t.Errorf("%q: wrong query, want: %q, got: %q", tc.query, tc.want, got)
+		}
+		wantURI := "/api"
+		if tc.want != "" {
+			wantURI += "?" + tc.want
+		}
+		if r.RequestURI != wantURI {
+			t.Errorf("%q: wrong request URI, want: %q, got: %q", tc.query, wantURI, r.RequestURI)
+		}
+	}
+}
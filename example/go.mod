@@ -7,3 +7,5 @@ require (
 	github.com/gorilla/mux v1.7.4
 	github.com/mikehelmick/go-chaff v0.2.1
 )
+
+replace github.com/mikehelmick/go-chaff => ../
@@ -40,14 +40,19 @@ func randInt(s int) (int64, error) {
 func main() {
 	r := mux.NewRouter()
 
-	track := chaff.New()
+	track := chaff.New(chaff.WithMarkerStripping())
 	defer track.Close()
 
+	detector := chaff.HeaderDetector(chaff.Header)
+
 	{
 		// Create a submodule
 		sub := r.PathPrefix("").Subrouter()
-		// Install the chaff tracker middleware.
-		sub.Use(track.Track)
+		// Install the chaff tracker middleware. Requests with the chaff header
+		// get a chaff response.
+		sub.Use(func(next http.Handler) http.Handler {
+			return track.HandleTrack(detector, next)
+		})
 		sub.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			sleep, err := randInt(1000)
 			if err != nil {
@@ -71,7 +76,9 @@ func main() {
 	}
 
 	srv := &http.Server{
-		Handler: handlers.CombinedLoggingHandler(os.Stdout, r),
+		// Strip the chaff header before logging, so chaff and real requests
+		// look the same in the access log.
+		Handler: chaff.StripMarkers(detector, handlers.CombinedLoggingHandler(os.Stdout, r)),
 		Addr:    "0.0.0.0:8080",
 	}
 	log.Printf("Listening on :%v", 8080)
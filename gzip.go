@@ -0,0 +1,247 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+const (
+	// Number of distinct words used to generate compressible chaff.
+	gzipVocabulary = 256
+	// Lower bound of the compression ratio of generated chaff.
+	gzipMinRatio = 0.1
+	// Maximum number of times a chaff body is compressed.
+	gzipPasses = 8
+	// Compressed sizes within 1/gzipTolerance of the target are accepted.
+	gzipTolerance = 200
+)
+
+// gzipRatio holds the float64 bits of the compression ratio of the last
+// generated body, the initial estimate for the next one.
+var gzipRatio uint64
+
+// EncodingResponder is a Responder that can write encoded response bodies.
+//
+// If the profile of a chaff response has a Content-Encoding the responder
+// supports and the request accepts, the Content-Encoding header is set on the
+// response before Write is called. The responder must then write a body
+// encoded with that coding, whose encoded size matches bodySize.
+type EncodingResponder interface {
+	Responder
+
+	// SupportsEncoding reports whether the responder can write bodies with the
+	// given content coding.
+	SupportsEncoding(coding string) bool
+}
+
+var _ EncodingResponder = (*GzipResponder)(nil)
+
+// GzipResponder writes random text like the PlainResponder. When the real
+// responses were gzip encoded and the chaff request accepts gzip, the body is
+// gzip compressed text, sized so that the compressed size matches the profile.
+//
+// For sizes to be recorded on the wire, Track must wrap any compression
+// middleware.
+type GzipResponder struct {
+}
+
+func (gr *GzipResponder) SupportsEncoding(coding string) bool {
+	return coding == "gzip"
+}
+
+func (gr *GzipResponder) Write(statusCode int, headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
+	PadHeaders(w, r, headerSize)
+	if bodySize == 0 || !BodyAllowedForStatus(statusCode) {
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(statusCode)
+		return nil
+	}
+
+	var body []byte
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		var err error
+		if body, err = gzipBody(bodySize); err != nil {
+			w.Header().Del("Content-Encoding")
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+	} else {
+		body = []byte(compressibleText(bodySize, newVocabulary()))
+	}
+
+	w.WriteHeader(statusCode)
+	_, err := w.Write(body)
+	return err
+}
+
+// gzipBody generates compressible text whose gzip encoding is close to size
+// bytes. The size is capped at MaxRandomBytes.
+//
+// The text length is estimated from the compression ratio of previous bodies
+// and then corrected from the measured sizes, compressing at most gzipPasses
+// times.
+func gzipBody(size uint64) ([]byte, error) {
+	if size > MaxRandomBytes {
+		size = MaxRandomBytes
+	}
+
+	vocab := newVocabulary()
+	var text []byte
+	var best []byte
+	var bestN int
+
+	// Bracket the target between a text length that compresses to less and
+	// one that compresses to more than size.
+	n := int(float64(size) / gzipEstimate())
+	lo, hi := 0, int(MaxRandomBytes/gzipMinRatio)
+	prevN, prevLen := -1, 0
+	for i := 0; i < gzipPasses && lo < hi; i++ {
+		if n > len(text) {
+			text = append(text, compressibleText(uint64(n-len(text)), vocab)...)
+		}
+		body, err := gzipBytes(text[:n])
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || absDiff(uint64(len(body)), size) < absDiff(uint64(len(best)), size) {
+			best, bestN = body, n
+		}
+		if absDiff(uint64(len(body)), size) <= size/gzipTolerance {
+			break
+		}
+		if uint64(len(body)) < size {
+			lo = n + 1
+		} else {
+			hi = n
+		}
+
+		// Compressed size grows about linearly with the text length, correct
+		// along the line through the last two measurements. Fall back to
+		// bisecting if that leaves the bracket.
+		next := n * int(size) / len(body)
+		if prevN >= 0 && len(body) != prevLen {
+			next = n + (int(size)-len(body))*(n-prevN)/(len(body)-prevLen)
+		}
+		if next < lo || next >= hi {
+			next = lo + (hi-lo)/2
+		}
+		prevN, prevLen = n, len(body)
+		n = next
+	}
+
+	if bestN > 0 {
+		atomic.StoreUint64(&gzipRatio, math.Float64bits(float64(len(best))/float64(bestN)))
+	}
+	return best, nil
+}
+
+// gzipEstimate returns the compression ratio of the last generated body.
+func gzipEstimate() float64 {
+	if r := math.Float64frombits(atomic.LoadUint64(&gzipRatio)); r >= gzipMinRatio {
+		return r
+	}
+	return gzipMinRatio
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newVocabulary returns random words of varying length. Text made of a small
+// vocabulary compresses like real text, unlike base64 noise.
+func newVocabulary() []string {
+	vocab := make([]string, gzipVocabulary)
+	for i := range vocab {
+		vocab[i] = random.String(3 + random.Index(8))
+	}
+	return vocab
+}
+
+// compressibleText returns size bytes of space separated words from vocab.
+func compressibleText(size uint64, vocab []string) string {
+	var sb strings.Builder
+	sb.Grow(int(size))
+	for uint64(sb.Len()) < size {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(vocab[random.Index(len(vocab))])
+	}
+	return sb.String()[:size]
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding header allows
+// the given content coding. An explicit entry for the coding takes precedence
+// over "*".
+func acceptsEncoding(r *http.Request, coding string) bool {
+	explicit, wildcard := -1.0, -1.0
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			switch name {
+			case coding:
+				explicit = qValue(fields[1:])
+			case "*":
+				wildcard = qValue(fields[1:])
+			}
+		}
+	}
+	if explicit >= 0 {
+		return explicit > 0
+	}
+	return wildcard > 0
+}
+
+// qValue returns the quality value of an Accept-Encoding entry from its
+// parameters. It defaults to 1, invalid values are treated as 0.
+func qValue(params []string) float64 {
+	for _, p := range params {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") && !strings.HasPrefix(p, "Q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(p[2:]), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+func absDiff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
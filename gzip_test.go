@@ -0,0 +1,188 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gzipMiddleware compresses all responses, like common compression middleware.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(rec.Body.Bytes())
+		gz.Close()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(rec.Code)
+		w.Write(buf.Bytes())
+	})
+}
+
+func TestGzipBody(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []uint64{500, 1000, 10000, 100000} {
+		body, err := gzipBody(size)
+		if err != nil {
+			t.Fatalf("gzipBody(%d): %v", size, err)
+		}
+		checkLength(t, int(size), len(body))
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		text, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		if len(text) <= len(body) {
+			t.Errorf("body of size %d is not compressible, got %d bytes of text", size, len(text))
+		}
+	}
+}
+
+func TestGzipBodyCapped(t *testing.T) {
+	t.Parallel()
+
+	body, err := gzipBody(10 * MaxRandomBytes)
+	if err != nil {
+		t.Fatalf("gzipBody: %v", err)
+	}
+	if got := len(body); got > MaxRandomBytes*101/100 {
+		t.Errorf("body not capped, want <= %d, got: %d", MaxRandomBytes, got)
+	}
+}
+
+func TestGzipResponder(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker(&GzipResponder{}, DefaultCapacity)
+	if err != nil {
+		t.Fatalf("error creating tracker: %v", err)
+	}
+	defer tracker.Close()
+
+	// Track wraps the compression middleware, so the encoded size is recorded.
+	srv := httptest.NewServer(tracker.HandleTrack(HeaderDetector(Header), gzipMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			items := make([]map[string]string, 200)
+			for i := range items {
+				items[i] = map[string]string{"name": "item", "value": RandomData(8)}
+			}
+			json.NewEncoder(w).Encode(items)
+		}))))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+	}
+	get := func(chaff bool, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		if chaff {
+			req.Header.Set(Header, "1")
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+		return resp
+	}
+
+	resp := get(false, "gzip")
+	realBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	waitForRecords(t, tracker, 1)
+
+	t.Run("accepts_gzip", func(t *testing.T) {
+		resp := get(true, "gzip, deflate")
+		defer resp.Body.Close()
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("wrong Content-Encoding, want: gzip, got: %q", got)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		checkLength(t, len(realBody), len(body))
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		if _, err := ioutil.ReadAll(gz); err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		resp := get(true, "")
+		defer resp.Body.Close()
+		if got := resp.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("unexpected Content-Encoding: %q", got)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		checkLength(t, len(realBody), len(body))
+	})
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"br", false},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"identity, gzip; q=0", false},
+		{"gzip;q=0.0", false},
+		{"gzip;q=0.000", false},
+		{"gzip;q=0.001", true},
+		{"*;q=1, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+		{"*;q=0, gzip", true},
+		{"*;q=0", false},
+		{"gzip;q=invalid", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			r.Header.Set("Accept-Encoding", tc.header)
+		}
+		if got := acceptsEncoding(r, "gzip"); got != tc.want {
+			t.Errorf("acceptsEncoding(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
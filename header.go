@@ -0,0 +1,218 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+// DefaultHeaderAllowlist is the set of response headers whose values are
+// copied verbatim into chaff responses. The values of all other headers are
+// replaced by random data of the same length.
+var DefaultHeaderAllowlist = []string{
+	"Cache-Control",
+	"Content-Type",
+	"Referrer-Policy",
+	"Strict-Transport-Security",
+	"Vary",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+}
+
+// framingHeaders are managed by net/http or describe the body encoding, they
+// are never mimicked in chaff responses.
+var framingHeaders = map[string]struct{}{
+	"Connection":        {},
+	"Content-Encoding":  {},
+	"Content-Length":    {},
+	"Date":              {},
+	"Trailer":           {},
+	"Transfer-Encoding": {},
+}
+
+// headerField is a single recorded response header. The value is only
+// retained for allowlisted headers, otherwise only its length is known.
+type headerField struct {
+	name  string
+	value string
+	size  int
+}
+
+// WithHeaderAllowlist replaces the DefaultHeaderAllowlist with the given header
+// names. Values of these headers are copied verbatim into chaff responses.
+// Never include headers that may carry sensitive data, like Set-Cookie.
+func WithHeaderAllowlist(names ...string) Option {
+	return func(t *Tracker) {
+		t.headerAllow = headerSet(names)
+	}
+}
+
+// WithHeaderDenylist prevents the given response headers from being recorded
+// at all. Neither their names nor their values appear in chaff responses.
+func WithHeaderDenylist(names ...string) Option {
+	return func(t *Tracker) {
+		t.headerDeny = headerSet(names)
+	}
+}
+
+func headerSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[http.CanonicalHeaderKey(n)] = struct{}{}
+	}
+	return set
+}
+
+// headerSize counts the bytes of all header names and values.
+func headerSize(h http.Header) uint64 {
+	var size uint64
+	for k, vals := range h {
+		size += uint64(len(k))
+		for _, v := range vals {
+			size += uint64(len(v))
+		}
+	}
+	return size
+}
+
+// recordHeaders captures the header names and value lengths of a real
+// response, respecting the tracker's allowlist and denylist.
+func (t *Tracker) recordHeaders(h http.Header) []headerField {
+	fields := make([]headerField, 0, len(h))
+	for k, vals := range h {
+		name := http.CanonicalHeaderKey(k)
+		if _, ok := framingHeaders[name]; ok {
+			continue
+		}
+		if _, ok := t.headerDeny[name]; ok {
+			continue
+		}
+		_, allowed := t.headerAllow[name]
+		for _, v := range vals {
+			f := headerField{name: name, size: len(v)}
+			if allowed {
+				f.value = v
+			}
+			fields = append(fields, f)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields
+}
+
+// writeHeaders adds the recorded header fields to h, generating random values
+// for headers whose value wasn't retained. It returns the number of header
+// bytes added, counted the same way as real responses are.
+func writeHeaders(fields []headerField, h http.Header) uint64 {
+	var size uint64
+	for _, f := range fields {
+		v := f.value
+		if v == "" {
+			v = random.String(f.size)
+		}
+		h.Add(f.name, v)
+		size += uint64(len(f.name) + len(v))
+	}
+	return size
+}
+
+// headerPadding describes where PadHeaders may add padding to a chaff
+// response.
+type headerPadding struct {
+	// names are the mimicked headers with random values.
+	names []string
+	// fallback is a recorded header with a random value that is added if none
+	// of the mimicked headers have random values.
+	fallback string
+}
+
+type headerPaddingContextKey struct{}
+
+func withHeaderPadding(ctx context.Context, p *headerPadding) context.Context {
+	return context.WithValue(ctx, headerPaddingContextKey{}, p)
+}
+
+// paddableHeaders returns the names of the fields whose values are random.
+func paddableHeaders(fields []headerField) []string {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, f := range fields {
+		if f.value != "" {
+			continue
+		}
+		if _, ok := seen[f.name]; ok {
+			continue
+		}
+		seen[f.name] = struct{}{}
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// spareHeader returns the name of a header with a random value from the
+// recorded requests, or the empty string if there is none.
+func spareHeader(records []*request) string {
+	start := random.Index(len(records))
+	for i := range records {
+		if names := paddableHeaders(records[(start+i)%len(records)].headers); len(names) > 0 {
+			return names[random.Index(len(names))]
+		}
+	}
+	return ""
+}
+
+// PadHeaders adds size bytes of padding to the response headers of a chaff
+// response. The padding is spread across the values of the mimicked headers
+// whose values are random, so that chaff carries no header that real
+// responses don't. Responders call it before WriteHeader with the header size
+// they were given, less the size of the headers they set themselves.
+//
+// If real responses only have allowlisted headers, or the responder isn't
+// called by a chaff handler, no padding is added.
+func PadHeaders(w http.ResponseWriter, r *http.Request, size uint64) {
+	p, _ := r.Context().Value(headerPaddingContextKey{}).(*headerPadding)
+	if p == nil {
+		return
+	}
+	padHeader(w.Header(), p, size)
+}
+
+// padHeader adds size bytes of padding to h, as described by p.
+func padHeader(h http.Header, p *headerPadding, size uint64) {
+	if size == 0 {
+		return
+	}
+	if len(p.names) == 0 {
+		if p.fallback != "" && size > uint64(len(p.fallback)) {
+			h.Add(p.fallback, random.String(int(size)-len(p.fallback)))
+		}
+		return
+	}
+
+	n := uint64(len(p.names))
+	for i, name := range p.names {
+		k := size / n
+		if uint64(i) < size%n {
+			k++
+		}
+		if vals := h[name]; k > 0 && len(vals) > 0 {
+			vals[len(vals)-1] += random.String(int(k))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordHeaders(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithHeaderDenylist("x-internal-trace"))
+	defer track.Close()
+
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", "1234")
+	h.Set("X-Internal-Trace", "abc123")
+	h.Add("Set-Cookie", "session=secret")
+	h.Add("Set-Cookie", "other=value")
+
+	got := track.recordHeaders(h)
+	want := []headerField{
+		{name: "Content-Type", value: "application/json", size: 16},
+		{name: "Set-Cookie", size: 14},
+		{name: "Set-Cookie", size: 11},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(headerField{})); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestChaffMimicsHeaders(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	track.recordRequest(&request{
+		statusCode: http.StatusOK,
+		headerSize: 60,
+		headers: []headerField{
+			{name: "Cache-Control", value: "no-store", size: 8},
+			{name: "Set-Cookie", size: 30},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	track.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if got, want := w.Header().Get("Cache-Control"), "no-store"; got != want {
+		t.Errorf("wrong Cache-Control, want: %q, got: %q", want, got)
+	}
+	if got := w.Header().Get("Set-Cookie"); len(got) != 30 {
+		t.Errorf("wrong Set-Cookie length, want: 30, got: %d", len(got))
+	}
+	// The remainder after the mimicked headers is spread across headers with
+	// random values.
+	if got := w.Header().Get(Header); got != "" {
+		t.Errorf("unexpected padding header: %q", got)
+	}
+	if got := len(w.Header().Get("Set-Cookie")); got < 30 || got > 42 {
+		t.Errorf("wrong padded Set-Cookie length, want: 30-42, got: %d", got)
+	}
+}
+
+func TestPadHeaders(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		padding *headerPadding
+		header  http.Header
+		size    uint64
+		want    http.Header
+	}{
+		{
+			name:    "spread",
+			padding: &headerPadding{names: []string{"Etag", "Set-Cookie"}},
+			header:  http.Header{"Etag": {"aa"}, "Set-Cookie": {"b", "bb"}},
+			size:    5,
+			want:    http.Header{"Etag": {"aa..."}, "Set-Cookie": {"b", "bb.."}},
+		},
+		{
+			name:    "fallback",
+			padding: &headerPadding{fallback: "Etag"},
+			header:  http.Header{"Vary": {"Accept"}},
+			size:    10,
+			want:    http.Header{"Etag": {"......"}, "Vary": {"Accept"}},
+		},
+		{
+			name:    "fallback too large",
+			padding: &headerPadding{fallback: "Etag"},
+			header:  http.Header{},
+			size:    4,
+			want:    http.Header{},
+		},
+		{
+			name:   "no chaff handler",
+			header: http.Header{"Etag": {"aa"}},
+			size:   10,
+			want:   http.Header{"Etag": {"aa"}},
+		},
+	}
+
+	// Only compare the lengths of values.
+	lengths := cmp.Transformer("lengths", func(h http.Header) map[string][]int {
+		m := make(map[string][]int, len(h))
+		for k, vals := range h {
+			for _, v := range vals {
+				m[k] = append(m[k], len(v))
+			}
+		}
+		return m
+	})
+
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.padding != nil {
+			r = r.WithContext(withHeaderPadding(r.Context(), tc.padding))
+		}
+		w := httptest.NewRecorder()
+		for k, v := range tc.header {
+			w.Header()[k] = v
+		}
+
+		PadHeaders(w, r, tc.size)
+		if diff := cmp.Diff(tc.want, w.Header(), lengths); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", tc.name, diff)
+		}
+	}
+}
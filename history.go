@@ -0,0 +1,351 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"math"
+	"time"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+// maxDecayExponent is the largest power of two a decaying history weighs
+// requests with before it moves its landmark, well below the range of
+// float64.
+const maxDecayExponent = 64
+
+// maxExemplars is the number of most recent requests a history keeps in full.
+// Chaff mimics their status codes, headers, encoding, JSON structure and write
+// cadence, while latency and sizes are drawn from all requests.
+const maxExemplars = 100
+
+// value is what a history keeps of every recorded request, so that it can be
+// removed from the distributions once it is evicted.
+type value struct {
+	recorded      int64
+	latencyMs     uint64
+	headerSize    uint64
+	bodySize      uint64
+	reqHeaderSize uint64
+	reqBodySize   uint64
+	reqReadMs     uint64
+	load          uint8
+}
+
+func newValue(r *request) value {
+	return value{
+		recorded:      r.recorded.UnixNano(),
+		latencyMs:     r.latencyMs,
+		headerSize:    r.headerSize,
+		bodySize:      r.bodySize,
+		reqHeaderSize: r.reqHeaderSize,
+		reqBodySize:   r.reqBodySize,
+		reqReadMs:     r.reqReadMs,
+		load:          r.load,
+	}
+}
+
+// history is a bounded queue of recorded requests. Entries are evicted once
+// the capacity is reached and, if a window is set, once they are older than
+// the window.
+//
+// The distributions of the recorded values are updated as requests are added
+// and evicted, so that profiles are drawn in constant time regardless of the
+// capacity. Only the most recent requests are kept in full.
+// It is not safe for concurrent use, the Tracker guards access to it.
+type history struct {
+	cap    int
+	window time.Duration
+
+	// values is a ring buffer of all entries, start is the oldest.
+	values []value
+	start  int
+	n      int
+
+	// exemplars are the newest len(exemplars) entries in full, oldest first.
+	exemplars []*request
+
+	// resp is the distribution of the responses. req is the distribution of
+	// the requests, its latency is the time handlers took to read the body.
+	resp *Distribution
+	req  *Distribution
+	// readBytes and readMs sum the size and read time of the request bodies
+	// that handlers read.
+	readBytes float64
+	readMs    float64
+
+	// load is the latency distribution of each load bucket, loadN the number
+	// of entries in it. Sketches are only created for buckets with entries.
+	load  [maxLoadBuckets]*Sketch
+	loadN [maxLoadBuckets]int
+
+	// If halfLife is set, the distributions decay instead of forgetting
+	// evicted entries. Entries are weighed relative to landmark, see weight.
+	halfLife time.Duration
+	landmark int64
+}
+
+func newHistory(cap int, window, halfLife time.Duration) *history {
+	return &history{
+		cap:      cap,
+		window:   window,
+		halfLife: halfLife,
+		resp:     newDistribution(),
+		req:      newDistribution(),
+	}
+}
+
+// add appends a request, evicting the oldest entries that are over capacity or
+// outside of the window.
+func (h *history) add(record *request) {
+	h.push(newValue(record))
+	h.exemplars = append(h.exemplars, record)
+	h.trimExemplars()
+	if h.window > 0 {
+		h.expire(record.recorded)
+	}
+}
+
+// addValue appends an entry that isn't kept in full. Since exemplars must be
+// the newest entries, existing exemplars are dropped.
+func (h *history) addValue(v value) {
+	h.push(v)
+	for i := range h.exemplars {
+		h.exemplars[i] = nil
+	}
+	h.exemplars = h.exemplars[:0]
+}
+
+// push appends an entry to the ring buffer and the distributions, evicting
+// the oldest entry if the history is full.
+func (h *history) push(v value) {
+	if h.n == h.cap {
+		h.evict(1)
+	}
+	if h.n == len(h.values) {
+		h.grow()
+	}
+	h.values[(h.start+h.n)%len(h.values)] = v
+	h.n++
+	h.loadN[v.load]++
+	h.include(v, h.weight(v.recorded))
+}
+
+// weight returns the weight of an entry recorded at the given time. Without a
+// half-life, all entries weigh the same.
+//
+// With a half-life, the history uses forward decay: entries weigh
+// 2^((recorded-landmark)/halfLife), so that an entry weighs twice as much as
+// one recorded a half-life earlier. Only the ratio between weights matters
+// for the mean and quantiles, so existing entries never need to be updated as
+// time passes. When weights grow too large, the landmark moves forward and the
+// distributions are scaled down to match.
+func (h *history) weight(recorded int64) float64 {
+	if h.halfLife <= 0 {
+		return 1
+	}
+	if h.landmark == 0 {
+		h.landmark = recorded
+	}
+	exp := float64(recorded-h.landmark) / float64(h.halfLife)
+	if exp > maxDecayExponent {
+		h.rebase(recorded)
+		exp = 0
+	}
+	return math.Exp2(exp)
+}
+
+// rebase moves the landmark of a decaying history.
+func (h *history) rebase(landmark int64) {
+	f := math.Exp2(-float64(landmark-h.landmark) / float64(h.halfLife))
+	h.resp.scale(f)
+	h.req.scale(f)
+	h.readBytes *= f
+	h.readMs *= f
+	for _, s := range h.load {
+		if s != nil {
+			s.scale(f)
+		}
+	}
+	h.landmark = landmark
+}
+
+// distribution returns a copy of the response distribution. The weights of
+// a decaying history are scaled so that an entry recorded now weighs 1, so
+// that distributions of histories with different landmarks can be merged.
+func (h *history) distribution(now time.Time) *Distribution {
+	d := newDistribution()
+	d.Merge(h.resp)
+	if h.halfLife > 0 && h.landmark != 0 {
+		d.scale(math.Exp2(-float64(now.UnixNano()-h.landmark) / float64(h.halfLife)))
+	}
+	return d
+}
+
+// grow enlarges the ring buffer, up to the capacity.
+func (h *history) grow() {
+	size := 2 * len(h.values)
+	if size == 0 {
+		size = 16
+	}
+	if size > h.cap {
+		size = h.cap
+	}
+	values := make([]value, size)
+	for i := 0; i < h.n; i++ {
+		values[i] = h.at(i)
+	}
+	h.values, h.start = values, 0
+}
+
+// at returns the i-th oldest entry.
+func (h *history) at(i int) value {
+	return h.values[(h.start+i)%len(h.values)]
+}
+
+// include adds (weight 1) or removes (weight -1) an entry from the
+// distributions.
+func (h *history) include(v value, weight float64) {
+	h.resp.Latency.add(float64(v.latencyMs), weight)
+	h.resp.HeaderSize.add(float64(v.headerSize), weight)
+	h.resp.BodySize.add(float64(v.bodySize), weight)
+	h.req.Latency.add(float64(v.reqReadMs), weight)
+	h.req.HeaderSize.add(float64(v.reqHeaderSize), weight)
+	h.req.BodySize.add(float64(v.reqBodySize), weight)
+	if v.reqReadMs != 0 {
+		h.readBytes += weight * float64(v.reqBodySize)
+		h.readMs += weight * float64(v.reqReadMs)
+	}
+	if v.load != 0 {
+		if h.load[v.load] == nil {
+			h.load[v.load] = &Sketch{}
+		}
+		h.load[v.load].add(float64(v.latencyMs), weight)
+	}
+}
+
+// evict drops the n oldest entries. Decaying histories keep them in the
+// distributions, where they fade away.
+func (h *history) evict(n int) {
+	for i := 0; i < n; i++ {
+		v := h.at(0)
+		h.loadN[v.load]--
+		if h.halfLife <= 0 {
+			h.include(v, -1)
+			if h.loadN[v.load] == 0 {
+				h.load[v.load] = nil
+			}
+		}
+		h.start = (h.start + 1) % len(h.values)
+		h.n--
+	}
+	h.trimExemplars()
+}
+
+// trimExemplars drops the oldest exemplars that exceed maxExemplars or the
+// number of entries.
+func (h *history) trimExemplars() {
+	max := maxExemplars
+	if h.n < max {
+		max = h.n
+	}
+	if drop := len(h.exemplars) - max; drop > 0 {
+		// Clear the references so the requests can be garbage collected, the
+		// backing array is reclaimed the next time append grows it.
+		for i := 0; i < drop; i++ {
+			h.exemplars[i] = nil
+		}
+		h.exemplars = h.exemplars[drop:]
+	}
+}
+
+// expire evicts the entries that are outside of the window as of now.
+func (h *history) expire(now time.Time) {
+	if h.window <= 0 {
+		return
+	}
+	cutoff := now.Add(-h.window).UnixNano()
+	n := 0
+	for n < h.n && h.at(n).recorded < cutoff {
+		n++
+	}
+	h.evict(n)
+}
+
+// empty reports whether the history has no entries within the window as of
+// now. Entries are only evicted periodically, so a history with a mix of
+// expired and current entries is not empty.
+func (h *history) empty(now time.Time) bool {
+	if h.n == 0 {
+		return true
+	}
+	return h.window > 0 && h.at(h.n-1).recorded < now.Add(-h.window).UnixNano()
+}
+
+// loadLatency returns the latency distribution of the given load bucket, or
+// nil if it has fewer than minLoadEntries entries.
+func (h *history) loadLatency(load uint8) *Sketch {
+	if load == 0 || h.loadN[load] < minLoadEntries {
+		return nil
+	}
+	return h.load[load]
+}
+
+// count returns the number of entries.
+func (h *history) count() int {
+	return h.n
+}
+
+// sample returns a random entry and, if it is one of the exemplars, the
+// entry in full. Otherwise a random exemplar is returned. The history must
+// not be empty.
+func (h *history) sample() (value, *request) {
+	i := h.sampleIndex()
+	if j := i - (h.n - len(h.exemplars)); j >= 0 {
+		return h.at(i), h.exemplars[j]
+	}
+	return h.at(i), h.exemplar()
+}
+
+// sampleIndex returns the index of a random entry. Entries of a decaying
+// history are picked with their decayed weight, so that samples favor recent
+// requests like the distributions do.
+func (h *history) sampleIndex() int {
+	if h.halfLife <= 0 || h.landmark == 0 {
+		return random.Index(h.n)
+	}
+	weight := func(i int) float64 {
+		return math.Exp2(float64(h.at(i).recorded-h.landmark) / float64(h.halfLife))
+	}
+	var total float64
+	for i := 0; i < h.n; i++ {
+		total += weight(i)
+	}
+	target := random.Float() * total
+	for i := 0; i < h.n; i++ {
+		if target -= weight(i); target < 0 {
+			return i
+		}
+	}
+	return h.n - 1
+}
+
+// exemplar returns a random exemplar. The history must not be empty.
+func (h *history) exemplar() *request {
+	if len(h.exemplars) == 0 {
+		return &request{}
+	}
+	return h.exemplars[random.Index(len(h.exemplars))]
+}
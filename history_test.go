@@ -0,0 +1,224 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func bodySizes(h *history) []uint64 {
+	sizes := make([]uint64, h.count())
+	for i := range sizes {
+		sizes[i] = h.at(i).bodySize
+	}
+	return sizes
+}
+
+func TestHistoryCapacity(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	h := newHistory(3, 0, 0)
+	for i := uint64(1); i <= 5; i++ {
+		h.add(&request{bodySize: i, recorded: now})
+	}
+
+	got := bodySizes(h)
+	if len(got) != 3 || got[0] != 3 || got[1] != 4 || got[2] != 5 {
+		t.Errorf("wrong records, want: [3 4 5], got: %v", got)
+	}
+	if got := h.resp.BodySize.Mean(); got != 4 {
+		t.Errorf("wrong mean, want: 4, got: %d", got)
+	}
+}
+
+func TestHistoryWindow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	h := newHistory(100, time.Minute, 0)
+	for i := uint64(1); i <= 5; i++ {
+		// One record every 30 seconds, the newest is recorded now.
+		h.add(&request{bodySize: i, recorded: now.Add(-time.Duration(5-i) * 30 * time.Second)})
+	}
+
+	// Entries older than the window are evicted on add.
+	if got := h.count(); got != 3 {
+		t.Errorf("wrong number of entries, want: 3, got: %d", got)
+	}
+
+	// And when expired.
+	h.expire(now.Add(45 * time.Second))
+	if got := bodySizes(h); len(got) != 1 || got[0] != 5 {
+		t.Errorf("wrong records, want: [5], got: %v", got)
+	}
+	if got := len(h.exemplars); got != 1 {
+		t.Errorf("wrong number of exemplars, want: 1, got: %d", got)
+	}
+
+	// A history whose newest entry is outside of the window is empty, even
+	// before it is expired.
+	if h.empty(now) {
+		t.Errorf("expected history to have current entries")
+	}
+	if !h.empty(now.Add(time.Hour)) {
+		t.Errorf("expected history to be empty")
+	}
+}
+
+func TestHistoryDistribution(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	h := newHistory(250, 0, 0)
+	for i := uint64(0); i < 1000; i++ {
+		h.add(&request{latencyMs: i % 7, bodySize: i, recorded: now})
+	}
+
+	// Evicted entries are removed from the distribution, which matches one
+	// built from the remaining entries.
+	want := newDistribution()
+	for i := uint64(750); i < 1000; i++ {
+		want.Latency.Add(i % 7)
+		want.HeaderSize.Add(0)
+		want.BodySize.Add(i)
+	}
+	for q := 0.0; q <= 1; q += 0.1 {
+		if got, want := h.resp.BodySize.Quantile(q), want.BodySize.Quantile(q); got != want {
+			t.Errorf("body size quantile %v, want: %d, got: %d", q, want, got)
+		}
+		if got, want := h.resp.Latency.Quantile(q), want.Latency.Quantile(q); got != want {
+			t.Errorf("latency quantile %v, want: %d, got: %d", q, want, got)
+		}
+	}
+	if got := h.resp.BodySize.Count(); got != 250 {
+		t.Errorf("wrong count, want: 250, got: %v", got)
+	}
+
+	// Only the newest entries are kept in full.
+	if got := len(h.exemplars); got != maxExemplars {
+		t.Errorf("wrong number of exemplars, want: %d, got: %d", maxExemplars, got)
+	}
+	if got, want := h.exemplars[0].bodySize, h.at(h.count()-maxExemplars).bodySize; got != want {
+		t.Errorf("exemplars are not the newest entries, want: %d, got: %d", want, got)
+	}
+	for i := 0; i < 100; i++ {
+		if v, r := h.sample(); r.bodySize != v.bodySize && v.bodySize >= 900 {
+			t.Errorf("sampled exemplar %d doesn't match value %d", r.bodySize, v.bodySize)
+		}
+	}
+}
+
+func TestCapacityLimits(t *testing.T) {
+	t.Parallel()
+
+	for _, cap := range []int{0, MaxCapacity + 1} {
+		if _, err := NewTracker(&PlainResponder{}, cap); err == nil {
+			t.Errorf("expected error for capacity %d", cap)
+		}
+	}
+
+	track, err := NewTracker(&PlainResponder{}, 100000, WithWindow(10*time.Minute))
+	if err != nil {
+		t.Fatalf("error creating tracker: %v", err)
+	}
+	defer track.Close()
+
+	for i := 0; i < 1000; i++ {
+		track.recordRequest(&request{bodySize: 100, recorded: time.Now()})
+	}
+	if got := track.all.count(); got != 1000 {
+		t.Errorf("wrong number of records, want: 1000, got: %d", got)
+	}
+}
+
+func TestHistoryDecay(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	h := newHistory(10, 0, time.Second)
+	for i := 0; i < 100; i++ {
+		h.add(&request{bodySize: 100, recorded: start})
+	}
+	// Ten half-lives later, the newer requests weigh 1024 times as much.
+	// Evicted requests still count with their decayed weight.
+	later := start.Add(10 * time.Second)
+	for i := 0; i < 100; i++ {
+		h.add(&request{bodySize: 1000, recorded: later})
+	}
+	if got, want := h.resp.BodySize.Mean(), uint64((100*100+100*1000*1024)/(100+100*1024)); got != want {
+		t.Errorf("wrong decayed mean, want: %d, got: %d", want, got)
+	}
+	checkAccuracy(t, 1000, h.resp.BodySize.Quantile(0.01))
+
+	// Normalized to now, a request recorded now weighs 1.
+	if got := h.distribution(later).BodySize.Count(); got < 100 || got > 101 {
+		t.Errorf("wrong normalized count, want: ~100, got: %v", got)
+	}
+
+	// Weights stay finite long after the landmark.
+	for i := 1; i <= 10; i++ {
+		h.add(&request{bodySize: 500, recorded: later.Add(time.Duration(i) * 100 * time.Second)})
+	}
+	if got := h.resp.BodySize.Mean(); got != 500 {
+		t.Errorf("wrong mean after rebasing, want: 500, got: %d", got)
+	}
+	if math.IsInf(h.resp.BodySize.Count(), 0) || math.IsNaN(h.resp.BodySize.Count()) {
+		t.Errorf("weights overflowed: %v", h.resp.BodySize.Count())
+	}
+}
+
+func TestWithHalfLife(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithHalfLife(time.Second), WithKeyFunc(MethodRawPathKey))
+	defer track.Close()
+
+	now := time.Now()
+	track.recordRequest(&request{key: "GET /", bodySize: 100, recorded: now.Add(-time.Minute)})
+	track.recordRequest(&request{key: "GET /", bodySize: 300, recorded: now})
+
+	// The old request has decayed to nothing.
+	for _, key := range []string{"", "GET /"} {
+		if got := track.calculateProfile(key).bodySize; got != 299 && got != 300 {
+			t.Errorf("key %q: wrong decayed mean, want: ~300, got: %d", key, got)
+		}
+	}
+}
+
+func TestSampleHalfLife(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithHalfLife(time.Second), WithProfileStrategy(SampleStrategy))
+	defer track.Close()
+
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		track.recordRequest(&request{bodySize: 100, reqBodySize: 10, recorded: now.Add(-time.Minute)})
+	}
+	track.recordRequest(&request{bodySize: 300, reqBodySize: 30, recorded: now})
+
+	// The old requests have decayed to nothing, so only the new one is sampled.
+	for i := 0; i < 20; i++ {
+		if got := track.CalculateProfile().bodySize; got != 300 {
+			t.Fatalf("sampled decayed request, want body size: 300, got: %d", got)
+		}
+		if got := track.RequestProfile().BodySize; got != 30 {
+			t.Fatalf("sampled decayed request, want request body size: 30, got: %d", got)
+		}
+	}
+}
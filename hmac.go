@@ -0,0 +1,158 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nonceSize is the number of random bytes in a chaff token, so that two tokens
+// minted in the same second differ.
+const nonceSize = 16
+
+var _ Detector = (*HMACDetector)(nil)
+
+// HMACDetector is a detector that only treats a request as chaff if it
+// carries a valid token minted with MintToken in the given header. Unlike
+// HeaderDetector, clients without the shared key can't force a chaff
+// response. To keep observers from telling chaff from real requests by the
+// presence of the header, real requests can send a token minted with a
+// different key.
+//
+// Tokens are valid for maxAge either side of the time they were minted. They
+// are not single use, a captured token can be replayed until it expires.
+type HMACDetector struct {
+	header string
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu   sync.RWMutex
+	keys [][]byte
+}
+
+// NewHMACDetector creates a detector that accepts tokens in header signed with
+// any of the given keys and minted at most maxAge ago.
+func NewHMACDetector(header string, maxAge time.Duration, keys ...[]byte) (*HMACDetector, error) {
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("maxAge must be positive, got: %v", maxAge)
+	}
+	d := &HMACDetector{
+		header: header,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+	if err := d.SetKeys(keys...); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetKeys replaces the keys tokens are verified against. To rotate keys
+// without rejecting chaff from clients that haven't picked up the new key,
+// set both the old and the new key, then drop the old key once all clients
+// mint with the new one.
+func (d *HMACDetector) SetKeys(keys ...[]byte) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one key is required")
+	}
+	copied := make([][]byte, len(keys))
+	for i, k := range keys {
+		if len(k) == 0 {
+			return fmt.Errorf("key %d is empty", i)
+		}
+		copied[i] = append([]byte(nil), k...)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = copied
+	return nil
+}
+
+// IsChaff reports whether the request carries a valid token in the
+// detector's header.
+func (d *HMACDetector) IsChaff(r *http.Request) bool {
+	token := r.Header.Get(d.header)
+	return token != "" && d.Verify(token) == nil
+}
+
+// StripMarker removes the token header and the PaddingHeader of a Transport
+// from the request.
+func (d *HMACDetector) StripMarker(r *http.Request) {
+	r.Header.Del(d.header)
+	r.Header.Del(PaddingHeader)
+}
+
+// Verify checks that token was minted with one of the detector's keys within
+// maxAge of now. It can be used to check tokens carried somewhere other than
+// a header, e.g. in a field of an encrypted request body.
+func (d *HMACDetector) Verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed chaff token")
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed chaff token timestamp: %w", err)
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed chaff token signature: %w", err)
+	}
+
+	if age := d.now().Sub(time.Unix(sec, 0)); age > d.maxAge || age < -d.maxAge {
+		return fmt.Errorf("chaff token expired")
+	}
+	d.mu.RLock()
+	keys := d.keys
+	d.mu.RUnlock()
+
+	for _, key := range keys {
+		if hmac.Equal(mac, tokenMAC(key, parts[0], parts[1])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("chaff token signature mismatch")
+}
+
+// MintToken creates a chaff token for a HMACDetector sharing key, valid
+// around the given time.
+func MintToken(key []byte, now time.Time) (string, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	mac := base64.RawURLEncoding.EncodeToString(tokenMAC(key, ts, nonce))
+	return ts + "." + nonce + "." + mac, nil
+}
+
+func tokenMAC(key []byte, ts, nonce string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(ts))
+	h.Write([]byte{'.'})
+	h.Write([]byte(nonce))
+	return h.Sum(nil)
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHMACDetector(t *testing.T) {
+	t.Parallel()
+
+	oldKey, newKey := []byte("old"), []byte("new")
+	now := time.Unix(1600000000, 0)
+
+	d, err := NewHMACDetector(Header, time.Minute, oldKey)
+	if err != nil {
+		t.Fatalf("NewHMACDetector: %v", err)
+	}
+	d.now = func() time.Time { return now }
+
+	mint := func(key []byte, at time.Time) string {
+		token, err := MintToken(key, at)
+		if err != nil {
+			t.Fatalf("MintToken: %v", err)
+		}
+		return token
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"valid", mint(oldKey, now), true},
+		{"within max age", mint(oldKey, now.Add(-59*time.Second)), true},
+		{"expired", mint(oldKey, now.Add(-2*time.Minute)), false},
+		{"future", mint(oldKey, now.Add(2*time.Minute)), false},
+		{"wrong key", mint(newKey, now), false},
+		{"plain header", "1", false},
+		{"missing", "", false},
+		{"bad signature", mint(oldKey, now)[:20] + ".AAAA", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.token != "" {
+			r.Header.Set(Header, tc.token)
+		}
+		if got := d.IsChaff(r); got != tc.want {
+			t.Errorf("%s: IsChaff() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Rotate keys, accepting both while clients migrate.
+	if err := d.SetKeys(newKey, oldKey); err != nil {
+		t.Fatalf("SetKeys: %v", err)
+	}
+	for _, key := range [][]byte{oldKey, newKey} {
+		if err := d.Verify(mint(key, now)); err != nil {
+			t.Errorf("Verify after rotation: %v", err)
+		}
+	}
+	if err := d.SetKeys(newKey); err != nil {
+		t.Fatalf("SetKeys: %v", err)
+	}
+	if err := d.Verify(mint(oldKey, now)); err == nil {
+		t.Errorf("expected old key to be rejected after rotation")
+	}
+}
+
+func TestNewHMACDetector(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewHMACDetector(Header, time.Minute); err == nil {
+		t.Errorf("expected error for no keys")
+	}
+	if _, err := NewHMACDetector(Header, time.Minute, []byte{}); err == nil {
+		t.Errorf("expected error for empty key")
+	}
+	if _, err := NewHMACDetector(Header, 0, []byte("key")); err == nil {
+		t.Errorf("expected error for zero max age")
+	}
+}
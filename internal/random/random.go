@@ -0,0 +1,53 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package random provides uniformly distributed random numbers from
+// crypto/rand, so that chaff timing and sizes can't be predicted.
+package random
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// Float returns a uniformly distributed value in [0, 1).
+func Float() float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// Index returns a uniformly distributed value in [0, n).
+func Index(n int) int {
+	i := int(Float() * float64(n))
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
+
+// String generates exactly n characters of random, header safe data.
+func String(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	buffer := make([]byte, base64.RawURLEncoding.DecodedLen(n)+1)
+	if _, err := rand.Read(buffer); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer)[:n]
+}
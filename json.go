@@ -22,7 +22,7 @@ import (
 
 const (
 	// Number of bytes added by the content type header for application/json
-	contentHeaderSize = uint64(31)
+	contentHeaderSize = uint64(len("Content-Type") + len("application/json"))
 )
 
 // ProduceJSONFn is a function for producing JSON responses.
@@ -47,7 +47,8 @@ func PaddingWriterFn(randomData string) interface{} {
 // that will be given the heuristically sized payload so you can transform
 // it into the struct that you want to serialize.
 type JSONResponder struct {
-	fn ProduceJSONFn
+	fn     ProduceJSONFn
+	shaped bool
 }
 
 // NewJSONResponse creates a new JSON responder
@@ -66,27 +67,46 @@ func DefaultJSONResponder() Responder {
 	}
 }
 
-func (j *JSONResponder) Write(headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
+// ShapedJSONResponder creates a JSON responder that generates random documents
+// with the same structure as real responses. The tracker must be configured
+// with WithJSONShapes. If no structure is known, it falls back to the
+// PaddingWriterFn.
+func ShapedJSONResponder() Responder {
+	return &JSONResponder{
+		fn:     PaddingWriterFn,
+		shaped: true,
+	}
+}
+
+func (j *JSONResponder) Write(statusCode int, headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
 	var bodyData []byte
 	var err error
-	if bodySize > 0 {
-		bodyData, err = json.Marshal(j.fn(RandomData(bodySize)))
+	if bodySize > 0 && BodyAllowedForStatus(statusCode) {
+		if shape := jsonShapeFromContext(r.Context()); j.shaped && shape != nil {
+			bodyData = shape.synthesize(bodySize)
+		} else {
+			bodyData, err = json.Marshal(j.fn(RandomData(bodySize)))
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "{\"error\": \"%v\"}", err.Error())
 			return err
 		}
 	}
 
-	const headerDiff = contentHeaderSize + uint64(len(Header))
-
-	w.WriteHeader(http.StatusOK)
-	// Generate the response details.
-	if headerSize > headerDiff {
-		w.Header().Add(Header, RandomData(headerSize-headerDiff))
+	// Headers must be set before WriteHeader, otherwise they are dropped. Keep
+	// the Content-Type of real responses, if the tracker mimicked it.
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		if headerSize > contentHeaderSize {
+			headerSize -= contentHeaderSize
+		} else {
+			headerSize = 0
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
+	PadHeaders(w, r, headerSize)
+	w.WriteHeader(statusCode)
 	fmt.Fprintf(w, "%s", bodyData)
 
 	return nil
@@ -35,8 +35,14 @@ func TestJSONChaff(t *testing.T) {
 	track := New()
 	defer track.Close()
 
-	// Seed the tracker with a single request.
-	track.recordRequest(&request{25, 250, 100})
+	// Seed the tracker with a single request. Padding is added to the header
+	// with a random value.
+	track.recordRequest(&request{
+		latencyMs:  25,
+		bodySize:   250,
+		headerSize: 100,
+		headers:    []headerField{{name: "X-Request-Id", size: 20}},
+	})
 
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest("GET", "/", strings.NewReader(""))
@@ -66,6 +72,9 @@ func TestJSONChaff(t *testing.T) {
 		}
 	}
 	checkLength(t, 100, headerSize)
+	if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("wrong Content-Type, want: %q, got: %q", want, got)
+	}
 
 	var response Example
 	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
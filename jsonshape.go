@@ -0,0 +1,282 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+type jsonKind int
+
+// mapKeys is the number of keys above which an object whose values all have
+// the same kind is considered a map keyed by data rather than a struct.
+const mapKeys = 16
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// jsonShape is the structure of a JSON document without its values. Object
+// keys, nesting, value types and the length of strings and numbers are kept.
+type jsonShape struct {
+	kind jsonKind
+	// size is the length of a string or number value.
+	size int
+	// keys and children are set for objects, children for arrays.
+	keys     []string
+	children []*jsonShape
+}
+
+// WithJSONShapes records the structure of real JSON responses of up to
+// maxBytes, so that a ShapedJSONResponder can generate chaff with the same
+// structure. Only keys, nesting, value types and lengths are recorded, never
+// values.
+//
+// Object keys are served to anyone who sends chaff and are written to
+// snapshots. Responses keyed by data, e.g. a map from user IDs or email
+// addresses to users, would leak those identifiers, so keys that look like
+// data and the keys of map-like objects are replaced by random keys of the
+// same form, see anonymizeKeys. Don't enable it for responses whose field names
+// are sensitive.
+func WithJSONShapes(maxBytes int) Option {
+	return func(t *Tracker) {
+		t.shapeMax = maxBytes
+	}
+}
+
+// isJSON reports whether the content type is a JSON media type.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// parseJSONShape parses the structure of a JSON document.
+func parseJSONShape(b []byte) (*jsonShape, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	shape, err := decodeShape(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON document")
+	}
+	return shape, nil
+}
+
+func decodeShape(dec *json.Decoder) (*jsonShape, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := tok.(type) {
+	case nil:
+		return &jsonShape{kind: jsonNull}, nil
+	case bool:
+		return &jsonShape{kind: jsonBool}, nil
+	case json.Number:
+		return &jsonShape{kind: jsonNumber, size: len(v)}, nil
+	case string:
+		return &jsonShape{kind: jsonString, size: len(v)}, nil
+	case json.Delim:
+		shape := &jsonShape{kind: jsonArray}
+		if v == '{' {
+			shape.kind = jsonObject
+		}
+		for dec.More() {
+			if shape.kind == jsonObject {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				shape.keys = append(shape.keys, key.(string))
+			}
+			child, err := decodeShape(dec)
+			if err != nil {
+				return nil, err
+			}
+			shape.children = append(shape.children, child)
+		}
+		// Consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		shape.anonymizeKeys()
+		return shape, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+// anonymizeKeys replaces the keys of an object that look like data rather than
+// field names with random keys of the same form. If the object looks like a
+// map, i.e. it has more than mapKeys keys and all values have the same kind,
+// all keys are replaced.
+func (s *jsonShape) anonymizeKeys() {
+	all := len(s.keys) > mapKeys
+	for _, c := range s.children {
+		if c.kind != s.children[0].kind {
+			all = false
+			break
+		}
+	}
+	for i, key := range s.keys {
+		if all || dataKey(key) {
+			s.keys[i] = randomLike(key)
+		}
+	}
+}
+
+// dataKey reports whether an object key looks like data, e.g. an ID or an
+// email address, rather than a field name.
+func dataKey(key string) bool {
+	if len(key) > 64 || strings.ContainsAny(key, "@ ") {
+		return true
+	}
+	digits := 0
+	for _, r := range key {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 4
+}
+
+// randomLike returns a random string of the same form as s: digits and ASCII
+// letters are replaced by random digits and letters of the same case, other
+// characters are kept.
+func randomLike(s string) string {
+	const (
+		lower = "abcdefghijklmnopqrstuvwxyz"
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		digit = "0123456789"
+	)
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = lower[random.Index(len(lower))]
+		case c >= 'A' && c <= 'Z':
+			b[i] = upper[random.Index(len(upper))]
+		case c >= '0' && c <= '9':
+			b[i] = digit[random.Index(len(digit))]
+		}
+	}
+	return string(b)
+}
+
+// stringBytes returns the total length of all strings in the document.
+func (s *jsonShape) stringBytes() int {
+	if s.kind == jsonString {
+		return s.size
+	}
+	total := 0
+	for _, c := range s.children {
+		total += c.stringBytes()
+	}
+	return total
+}
+
+// synthesize generates a random document with the same structure, scaling the
+// length of strings so that the document is close to size bytes.
+func (s *jsonShape) synthesize(size uint64) []byte {
+	var buf bytes.Buffer
+	s.write(&buf, 1)
+	natural := buf.Len()
+
+	strBytes := s.stringBytes()
+	if strBytes == 0 || natural == int(size) {
+		return buf.Bytes()
+	}
+	scale := float64(int(size)-natural+strBytes) / float64(strBytes)
+	if scale < 0 {
+		scale = 0
+	}
+
+	buf.Reset()
+	s.write(&buf, scale)
+	return buf.Bytes()
+}
+
+func (s *jsonShape) write(buf *bytes.Buffer, scale float64) {
+	switch s.kind {
+	case jsonNull:
+		buf.WriteString("null")
+	case jsonBool:
+		if random.Index(2) == 0 {
+			buf.WriteString("false")
+		} else {
+			buf.WriteString("true")
+		}
+	case jsonNumber:
+		buf.WriteByte(byte('1' + random.Index(9)))
+		for i := 1; i < s.size; i++ {
+			buf.WriteByte(byte('0' + random.Index(10)))
+		}
+	case jsonString:
+		buf.WriteByte('"')
+		buf.WriteString(random.String(int(float64(s.size)*scale + 0.5)))
+		buf.WriteByte('"')
+	case jsonArray:
+		buf.WriteByte('[')
+		for i, c := range s.children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			c.write(buf, scale)
+		}
+		buf.WriteByte(']')
+	case jsonObject:
+		buf.WriteByte('{')
+		for i, c := range s.children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(s.keys[i])
+			buf.Write(key)
+			buf.WriteByte(':')
+			c.write(buf, scale)
+		}
+		buf.WriteByte('}')
+	}
+}
+
+type jsonShapeContextKey struct{}
+
+// withJSONShape passes the shape of the profile to the responder.
+func withJSONShape(ctx context.Context, shape *jsonShape) context.Context {
+	return context.WithValue(ctx, jsonShapeContextKey{}, shape)
+}
+
+func jsonShapeFromContext(ctx context.Context) *jsonShape {
+	shape, _ := ctx.Value(jsonShapeContextKey{}).(*jsonShape)
+	return shape
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const exampleJSON = `{"user":{"id":12345,"name":"alice","admin":false,"manager":null},"tags":["a","bb","ccc"],"total":3.5}`
+
+func TestJSONShapeRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	shape, err := parseJSONShape([]byte(exampleJSON))
+	if err != nil {
+		t.Fatalf("parseJSONShape: %v", err)
+	}
+
+	// Booleans are random, so the size may differ by a byte.
+	doc := shape.synthesize(uint64(len(exampleJSON)))
+	checkLength(t, len(exampleJSON), len(doc))
+	if strings.Contains(string(doc), "alice") {
+		t.Errorf("values were copied: %s", doc)
+	}
+
+	got, err := parseJSONShape(doc)
+	if err != nil {
+		t.Fatalf("synthesized invalid JSON %s: %v", doc, err)
+	}
+	if diff := cmp.Diff(shape, got, cmp.AllowUnexported(jsonShape{})); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestJSONShapeSize(t *testing.T) {
+	t.Parallel()
+
+	shape, err := parseJSONShape([]byte(exampleJSON))
+	if err != nil {
+		t.Fatalf("parseJSONShape: %v", err)
+	}
+
+	for _, size := range []int{1000, 10000} {
+		doc := shape.synthesize(uint64(size))
+		checkLength(t, size, len(doc))
+		if !json.Valid(doc) {
+			t.Errorf("synthesized invalid JSON: %s", doc)
+		}
+	}
+}
+
+func TestAnonymizeKeys(t *testing.T) {
+	t.Parallel()
+
+	shape, err := parseJSONShape([]byte(`{"users":{"alice@example.com":{"id":1},"12345678":{"id":2}},"count":2}`))
+	if err != nil {
+		t.Fatalf("parseJSONShape: %v", err)
+	}
+	if diff := cmp.Diff([]string{"users", "count"}, shape.keys); diff != "" {
+		t.Errorf("field names changed (-want, +got):\n%s", diff)
+	}
+	users := shape.children[0]
+	for i, orig := range []string{"alice@example.com", "12345678"} {
+		got := users.keys[i]
+		if got == orig || len(got) != len(orig) {
+			t.Errorf("key %q not replaced by a random key of the same length, got: %q", orig, got)
+		}
+		if got := users.children[i].keys; len(got) != 1 || got[0] != "id" {
+			t.Errorf("nested field names changed, got: %v", got)
+		}
+	}
+	if got := users.keys[0]; strings.Count(got, "@") != 1 || strings.Count(got, ".") != 1 {
+		t.Errorf("email key lost its form, got: %q", got)
+	}
+
+	// Objects with many keys whose values are alike are maps, objects with
+	// values of different kinds are structs.
+	var mapDoc, structDoc []string
+	for i := 0; i <= mapKeys; i++ {
+		mapDoc = append(mapDoc, fmt.Sprintf(`"k%02d":1`, i))
+		if i%2 == 0 {
+			structDoc = append(structDoc, fmt.Sprintf(`"k%02d":1`, i))
+		} else {
+			structDoc = append(structDoc, fmt.Sprintf(`"k%02d":"v"`, i))
+		}
+	}
+	for _, tc := range []struct {
+		doc  []string
+		kept bool
+	}{
+		{mapDoc, false},
+		{structDoc, true},
+	} {
+		shape, err := parseJSONShape([]byte("{" + strings.Join(tc.doc, ",") + "}"))
+		if err != nil {
+			t.Fatalf("parseJSONShape: %v", err)
+		}
+		kept := 0
+		for i, key := range shape.keys {
+			if key == fmt.Sprintf("k%02d", i) {
+				kept++
+			}
+		}
+		if got := kept == len(shape.keys); got != tc.kept {
+			t.Errorf("%s: keys kept: %d of %d", tc.doc[1], kept, len(shape.keys))
+		}
+	}
+}
+
+func TestParseJSONShapeErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, doc := range []string{"", "{", `{"a":1}{"b":2}`, "not json"} {
+		if _, err := parseJSONShape([]byte(doc)); err == nil {
+			t.Errorf("expected error parsing %q", doc)
+		}
+	}
+}
+
+func TestShapedJSONResponder(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker(ShapedJSONResponder(), DefaultCapacity, WithJSONShapes(64*1024))
+	if err != nil {
+		t.Fatalf("error creating tracker: %v", err)
+	}
+	defer tracker.Close()
+
+	handler := tracker.HandleTrack(HeaderDetector(Header),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(exampleJSON))
+		}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	waitForRecords(t, tracker, 1)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(Header, "1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON response %s: %v", w.Body.String(), err)
+	}
+	user, ok := got["user"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("chaff response doesn't have the real structure: %s", w.Body.String())
+	}
+	if _, ok := user["name"].(string); !ok {
+		t.Errorf("chaff response doesn't have the real structure: %s", w.Body.String())
+	}
+	checkLength(t, len(exampleJSON), w.Body.Len())
+}
+
+func TestCaptureBody(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		contentType string
+		encoding    string
+		max         int
+		want        bool
+	}{
+		{"json", "application/json", "", 1024, true},
+		{"problem_json", "application/problem+json", "", 1024, true},
+		{"disabled", "application/json", "", 0, false},
+		{"not_json", "text/html", "", 1024, false},
+		{"encoded", "application/json", "gzip", 1024, false},
+		{"too_large", "application/json", "", 10, false},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", tc.contentType)
+		if tc.encoding != "" {
+			rec.Header().Set("Content-Encoding", tc.encoding)
+		}
+		wt := &writeThrough{w: rec, captureMax: tc.max}
+		wt.Write([]byte(exampleJSON[:20]))
+		wt.Write([]byte(exampleJSON[20:]))
+
+		if got := wt.Body() != nil; got != tc.want {
+			t.Errorf("%s: captured = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"strings"
+)
+
+// MaxKeys is the maximum number of distinct keys a single tracker will keep
+// separate profiles for. Requests for keys beyond this limit are only
+// recorded in the tracker's global profile.
+const MaxKeys = 1000
+
+// KeyFunc buckets requests so that the tracker can keep a separate profile for
+// each key. The same function is applied to chaff requests to select the
+// profile they should impersonate.
+//
+// Keys should have low cardinality, e.g. a route pattern rather than a full
+// path containing IDs.
+type KeyFunc func(r *http.Request) string
+
+// MethodRawPathKey keys requests by their method and raw URL path. Only use it
+// if the set of paths is small and fixed. If paths contain IDs, the first
+// MaxKeys distinct paths use up all keys and every other route is only
+// profiled globally, use MethodRouteKey instead.
+func MethodRawPathKey(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// MethodRouteKey keys requests by their method and the first route pattern
+// that matches their URL path. Pattern segments in braces, e.g.
+// "/users/{id}", match any single path segment and a trailing "*" matches the
+// rest of the path. Requests that match no pattern are only recorded in the
+// global profile.
+func MethodRouteKey(patterns ...string) KeyFunc {
+	routes := make([][]string, len(patterns))
+	for i, p := range patterns {
+		routes[i] = splitPath(p)
+	}
+	return func(r *http.Request) string {
+		segments := splitPath(r.URL.Path)
+		for i, route := range routes {
+			if matchRoute(route, segments) {
+				return r.Method + " " + patterns[i]
+			}
+		}
+		return ""
+	}
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func matchRoute(route, segments []string) bool {
+	for i, r := range route {
+		if r == "*" && i == len(route)-1 {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(r, "{") && strings.HasSuffix(r, "}") {
+			continue
+		}
+		if r != segments[i] {
+			return false
+		}
+	}
+	return len(route) == len(segments)
+}
+
+// HeaderKey keys requests by the value of the given header.
+func HeaderKey(h string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(h)
+	}
+}
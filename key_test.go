@@ -0,0 +1,116 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeyedProfiles(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithKeyFunc(MethodRawPathKey))
+	defer track.Close()
+
+	handler := track.HandleTrack(HeaderDetector(Header),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				w.Write([]byte(strings.Repeat("a", 100)))
+			case "/upload":
+				w.Write([]byte(strings.Repeat("a", 1000)))
+			}
+		}))
+
+	for _, path := range []string{"/health", "/upload"} {
+		r := httptest.NewRequest("GET", path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	waitForRecords(t, track, 2)
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{"/health", 100},
+		{"/upload", 1000},
+		// Unknown keys fall back to the global profile.
+		{"/unknown", 550},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Header.Set(Header, "1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		checkLength(t, tc.want, w.Body.Len())
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithKeyFunc(MethodRawPathKey))
+	defer track.Close()
+
+	for i := 0; i < MaxKeys+10; i++ {
+		track.recordRequest(&request{bodySize: uint64(i), key: strings.Repeat("k", i)})
+	}
+
+	if got := len(track.keyed); got != MaxKeys {
+		t.Errorf("wrong number of keys, want: %d, got: %d", MaxKeys, got)
+	}
+	if got := track.all.count(); got != DefaultCapacity {
+		t.Errorf("global history not updated, want: %d, got: %d", DefaultCapacity, got)
+	}
+}
+
+func TestMethodRouteKey(t *testing.T) {
+	t.Parallel()
+
+	key := MethodRouteKey("/users/{id}", "/users/{id}/posts", "/static/*", "/")
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/users/123", "GET /users/{id}"},
+		{"/users/456/", "GET /users/{id}"},
+		{"/users/123/posts", "GET /users/{id}/posts"},
+		{"/static/css/site.css", "GET /static/*"},
+		{"/", "GET /"},
+		{"/users", ""},
+		{"/users/123/likes", ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if got := key(r); got != tc.want {
+			t.Errorf("key(%q): want: %q, got: %q", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestHeaderKey(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tenant", "acme")
+	if got, want := HeaderKey("X-Tenant")(r), "acme"; got != want {
+		t.Errorf("wrong key, want: %q, got: %q", want, got)
+	}
+}
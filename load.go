@@ -0,0 +1,85 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// maxLoadBuckets is the number of load buckets a history keeps the latency
+// of. Bucket 0 is for requests recorded without their load, bucket b for
+// requests with 2^(b-1) to 2^b-1 requests in flight, the last bucket for
+// anything above.
+const maxLoadBuckets = 16
+
+// minLoadEntries is the number of requests a load bucket needs before chaff
+// latency is drawn from it.
+const minLoadEntries = 10
+
+// WithLoadConditioning draws the latency of chaff responses from real requests
+// that were handled under a similar load, measured by the number of tracked
+// requests in flight, so that chaff slows down at peak like real responses
+// do. Load buckets grow exponentially, a bucket needs a few requests before
+// it is used.
+//
+// Only requests handled by Track and HandleTrack are counted, chaff requests
+// and Observations don't add to the load. Summaries don't carry the load, so
+// the local latency under load takes precedence over a ProfileStore.
+func WithLoadConditioning() Option {
+	return func(t *Tracker) {
+		t.loadAware = true
+	}
+}
+
+// loadBucket returns the load bucket for n requests in flight.
+func loadBucket(n int64) uint8 {
+	if n <= 0 {
+		return 0
+	}
+	b := bits.Len64(uint64(n))
+	if b >= maxLoadBuckets {
+		b = maxLoadBuckets - 1
+	}
+	return uint8(b)
+}
+
+// beginLoad counts a request in flight and returns its load bucket, including
+// the request itself. The caller must call endLoad once it is handled.
+func (t *Tracker) beginLoad() uint8 {
+	return loadBucket(atomic.AddInt64(&t.inflight, 1))
+}
+
+func (t *Tracker) endLoad() {
+	atomic.AddInt64(&t.inflight, -1)
+}
+
+// currentLoad returns the load bucket a real request arriving now would be
+// recorded in.
+func (t *Tracker) currentLoad() uint8 {
+	return loadBucket(atomic.LoadInt64(&t.inflight) + 1)
+}
+
+// conditionLoad replaces the latency of profile with one drawn from the
+// requests of h recorded under the current load, if there are enough.
+func (t *Tracker) conditionLoad(h *history, profile *request) {
+	s := h.loadLatency(t.currentLoad())
+	if s == nil {
+		return
+	}
+	latencyMs := t.strategy.drawLatency(s)
+	profile.writes = scaleWrites(profile.writes, profile.bodySize, profile.bodySize, profile.latencyMs, latencyMs)
+	profile.latencyMs = latencyMs
+}
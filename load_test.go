@@ -0,0 +1,119 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoadBucket(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		n    int64
+		want uint8
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{1000, 10},
+		{1 << 40, maxLoadBuckets - 1},
+	}
+	for _, tc := range cases {
+		if got := loadBucket(tc.n); got != tc.want {
+			t.Errorf("loadBucket(%d): want: %d, got: %d", tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestLoadConditioning(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithLoadConditioning())
+	defer track.Close()
+
+	for i := 0; i < minLoadEntries; i++ {
+		track.recordRequest(&request{latencyMs: 10, load: loadBucket(1)})
+		track.recordRequest(&request{latencyMs: 200, load: loadBucket(6)})
+	}
+	// A single request isn't enough for a load bucket.
+	track.recordRequest(&request{latencyMs: 5000, load: loadBucket(100)})
+
+	cases := []struct {
+		name     string
+		inflight int64
+		want     uint64
+	}{
+		{"quiet", 0, 10},
+		{"busy", 5, 200},
+		{"few requests at load", 99, 338},
+	}
+	for _, tc := range cases {
+		atomic.StoreInt64(&track.inflight, tc.inflight)
+		if got := track.CalculateProfile().latencyMs; got != tc.want {
+			t.Errorf("%s: wrong latency, want: %d, got: %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestTrackLoad(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithLoadConditioning())
+	defer track.Close()
+
+	var inflight int64
+	handler := track.Track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight = atomic.LoadInt64(&track.inflight)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	waitForRecords(t, track, 1)
+
+	if inflight != 1 {
+		t.Errorf("wrong requests in flight while handling, want: 1, got: %d", inflight)
+	}
+	if got := atomic.LoadInt64(&track.inflight); got != 0 {
+		t.Errorf("wrong requests in flight after handling, want: 0, got: %d", got)
+	}
+	track.mu.RLock()
+	load := track.all.at(0).load
+	track.mu.RUnlock()
+	if load != 1 {
+		t.Errorf("wrong load bucket, want: 1, got: %d", load)
+	}
+}
+
+func TestRestoreInvalidLoad(t *testing.T) {
+	t.Parallel()
+
+	snapshots := []string{
+		`{"version": 2, "histories": [{"values": [{"t": 1590969600000, "l": 10, "h": 1, "b": 1, "ld": 16}]}]}`,
+		`{"version": 2, "histories": [{"exemplars": [{"recorded": "2020-06-01T00:00:00Z", "load": 200}]}]}`,
+	}
+	for i, snapshot := range snapshots {
+		track := New(WithLoadConditioning())
+		defer track.Close()
+
+		if err := track.Restore(strings.NewReader(snapshot)); err == nil {
+			t.Errorf("%d: expected error for load bucket out of range", i)
+		}
+	}
+}
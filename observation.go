@@ -0,0 +1,91 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Observation describes a real request that was served outside of the
+// tracker's http handlers, e.g. by a gRPC server.
+type Observation struct {
+	// Key selects the per-key profile the observation is added to, in addition
+	// to the global profile. An empty key only adds to the global profile.
+	Key     string
+	Latency time.Duration
+	// Header and BodySize describe the response. The header is recorded like
+	// the headers of http responses, respecting the allowlist and denylist.
+	Header   http.Header
+	BodySize uint64
+	// RequestHeaderSize and RequestBodySize are the size of the request.
+	RequestHeaderSize uint64
+	RequestBodySize   uint64
+}
+
+// Record adds the observation to the tracker. Like tracked http requests, the
+// observation is dropped if too many are waiting to be recorded.
+func (t *Tracker) Record(o Observation) {
+	end := time.Now()
+	record := newRequest(o.Key, end.Add(-o.Latency), end, http.StatusOK, headerSize(o.Header), o.BodySize)
+	record.recorded = t.now()
+	record.headers = t.recordHeaders(o.Header)
+	record.reqHeaderSize = o.RequestHeaderSize
+	record.reqBodySize = o.RequestBodySize
+
+	select {
+	case t.ch <- record:
+	default: // channel full, drop request.
+	}
+}
+
+// Profile is the latency and response of the next chaff response.
+type Profile struct {
+	Latency time.Duration
+	// Header mimics the headers of real responses and is padded to
+	// HeaderSize, as far as possible without adding headers that real
+	// responses don't have.
+	Header     http.Header
+	HeaderSize uint64
+	BodySize   uint64
+}
+
+// KeyProfile returns the profile of the next chaff response for the given key,
+// as determined by the tracker's ProfileStrategy. If no requests are recorded
+// for the key, the global profile is used.
+func (t *Tracker) KeyProfile(key string) Profile {
+	p := t.calculateProfile(key)
+
+	h := make(http.Header)
+	if added := writeHeaders(p.headers, h); added < p.headerSize {
+		padHeader(h, &headerPadding{
+			names:    paddableHeaders(p.headers),
+			fallback: p.padHeader,
+		}, p.headerSize-added)
+	}
+	return Profile{
+		Latency:    time.Duration(p.latencyMs) * time.Millisecond,
+		Header:     h,
+		HeaderSize: p.headerSize,
+		BodySize:   p.bodySize,
+	}
+}
+
+// Wait blocks until latency has passed since start. It returns early if the
+// context is done or the tracker is closed.
+func (t *Tracker) Wait(ctx context.Context, start time.Time, latency time.Duration) {
+	t.normalizeLatency(ctx, start, uint64(latency.Milliseconds()))
+}
@@ -19,13 +19,11 @@ import "net/http"
 type PlainResponder struct {
 }
 
-func (pr *PlainResponder) Write(headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
-	w.WriteHeader(http.StatusOK)
-	// Generate the response details.
-	if headerSize > 0 {
-		w.Header().Add(Header, RandomData(headerSize))
-	}
-	if bodySize > 0 {
+func (pr *PlainResponder) Write(statusCode int, headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error {
+	// Headers must be set before WriteHeader, otherwise they are dropped.
+	PadHeaders(w, r, headerSize)
+	w.WriteHeader(statusCode)
+	if bodySize > 0 && BodyAllowedForStatus(statusCode) {
 		if _, err := w.Write([]byte(RandomData(bodySize))); err != nil {
 			return err
 		}
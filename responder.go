@@ -19,6 +19,22 @@ import "net/http"
 // Responder allows you to extend the chaff library with custom
 // responders.
 type Responder interface {
-	// Writes the appropriately sized header and body in the desired format.
-	Write(headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error
+	// Writes the status code and the appropriately sized header and body in
+	// the desired format. All headers must be set before calling WriteHeader
+	// on w, net/http silently drops headers that are set afterwards.
+	Write(statusCode int, headerSize, bodySize uint64, w http.ResponseWriter, r *http.Request) error
+}
+
+// BodyAllowedForStatus reports whether a given response status code permits a
+// body. Responders must not write a body for other status codes.
+func BodyAllowedForStatus(statusCode int) bool {
+	switch {
+	case statusCode >= 100 && statusCode <= 199:
+		return false
+	case statusCode == http.StatusNoContent:
+		return false
+	case statusCode == http.StatusNotModified:
+		return false
+	}
+	return true
 }
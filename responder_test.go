@@ -0,0 +1,134 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingListener counts the bytes written by the server to all connections.
+type countingListener struct {
+	net.Listener
+	written *uint64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c, written: l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.written, uint64(n))
+	return n, err
+}
+
+func TestWireSize(t *testing.T) {
+	t.Parallel()
+
+	responders := map[string]Responder{
+		"plain": &PlainResponder{},
+		"json":  DefaultJSONResponder(),
+	}
+
+	for name, responder := range responders {
+		name, responder := name, responder
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tracker, err := NewTracker(responder, DefaultCapacity)
+			if err != nil {
+				t.Fatalf("error creating tracker: %v", err)
+			}
+			defer tracker.Close()
+
+			var count uint64
+			handler := tracker.HandleTrack(HeaderDetector(Header),
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Alternate between small and large headers, so the profile
+					// relies on padding in addition to the mimicked headers.
+					if atomic.AddUint64(&count, 1)%2 == 0 {
+						w.Header().Set("X-Large", strings.Repeat("l", 500))
+					}
+					w.Header().Set("Content-Type", "application/json; charset=utf-8")
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(strings.Repeat("b", 1000)))
+				}))
+
+			var written uint64
+			srv := httptest.NewUnstartedServer(handler)
+			srv.Listener = &countingListener{Listener: srv.Listener, written: &written}
+			srv.Start()
+			defer srv.Close()
+
+			client := &http.Client{
+				Transport: &http.Transport{DisableKeepAlives: true},
+			}
+
+			const n = 20
+			send := func(chaff bool) (uint64, *http.Response) {
+				var total uint64
+				var resp *http.Response
+				for i := 0; i < n; i++ {
+					req, err := http.NewRequest("GET", srv.URL, nil)
+					if err != nil {
+						t.Fatalf("http.NewRequest: %v", err)
+					}
+					if chaff {
+						req.Header.Set(Header, "1")
+					}
+					before := atomic.LoadUint64(&written)
+					resp, err = client.Do(req)
+					if err != nil {
+						t.Fatalf("error sending request: %v", err)
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					total += atomic.LoadUint64(&written) - before
+				}
+				return total / n, resp
+			}
+
+			real, _ := send(false)
+
+			waitForRecords(t, tracker, n)
+
+			chaff, resp := send(true)
+			if got, want := resp.Header.Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+				t.Errorf("wrong Content-Type, want: %q, got: %q", want, got)
+			}
+
+			t.Logf("average wire size, real: %d chaff: %d", real, chaff)
+			if lower, upper := float64(real)*0.95, float64(real)*1.05; float64(chaff) < lower || float64(chaff) > upper {
+				t.Errorf("chaff wire size not within 5%% of real, want: %d, got: %d", real, chaff)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// sketchAccuracy is the relative accuracy of the quantiles of a Sketch.
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch is a mergeable histogram of non-negative values, like latencies and
+// sizes. Values are counted in logarithmically sized buckets, so quantiles
+// are accurate to within 1% of the real value and memory grows with the
+// range of values rather than their number. Sketches of the same kind of
+// value, e.g. from different replicas, can be merged without losing accuracy.
+//
+// The zero value is an empty sketch. It is not safe for concurrent use.
+type Sketch struct {
+	// zero counts values below 1, which have no logarithmic bucket.
+	zero float64
+	// offset is the bucket index of counts[0].
+	offset int
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+// Add adds a value to the sketch.
+func (s *Sketch) Add(v uint64) {
+	s.add(float64(v), 1)
+}
+
+func (s *Sketch) add(v, weight float64) {
+	s.count += weight
+	s.sum += v * weight
+	if v < 1 {
+		s.zero += weight
+		return
+	}
+	i := sketchIndex(v)
+	s.grow(i)
+	s.counts[i-s.offset] += weight
+	if weight < 0 {
+		s.trim()
+	}
+}
+
+// trim drops the empty buckets at either end, e.g. after values were removed.
+func (s *Sketch) trim() {
+	lo, hi := 0, len(s.counts)
+	for lo < hi && s.counts[lo] <= 0 {
+		lo++
+	}
+	for hi > lo && s.counts[hi-1] <= 0 {
+		hi--
+	}
+	if lo == hi {
+		s.counts, s.offset = nil, 0
+		return
+	}
+	s.counts, s.offset = s.counts[lo:hi], s.offset+lo
+}
+
+// grow extends counts to include bucket i.
+func (s *Sketch) grow(i int) {
+	switch {
+	case len(s.counts) == 0:
+		s.offset = i
+		s.counts = make([]float64, 1)
+	case i < s.offset:
+		counts := make([]float64, len(s.counts)+s.offset-i)
+		copy(counts[s.offset-i:], s.counts)
+		s.counts, s.offset = counts, i
+	case i >= s.offset+len(s.counts):
+		s.counts = append(s.counts, make([]float64, i-s.offset-len(s.counts)+1)...)
+	}
+}
+
+// scale multiplies the weight of all values in the sketch by f.
+func (s *Sketch) scale(f float64) {
+	s.zero *= f
+	s.count *= f
+	s.sum *= f
+	for i := range s.counts {
+		s.counts[i] *= f
+	}
+}
+
+// Merge adds all values of o to the sketch.
+func (s *Sketch) Merge(o *Sketch) {
+	if o == nil {
+		return
+	}
+	s.count += o.count
+	s.sum += o.sum
+	s.zero += o.zero
+	if len(o.counts) == 0 {
+		return
+	}
+	s.grow(o.offset)
+	s.grow(o.offset + len(o.counts) - 1)
+	for j, c := range o.counts {
+		s.counts[o.offset+j-s.offset] += c
+	}
+}
+
+// Count returns the number of values in the sketch.
+func (s *Sketch) Count() float64 {
+	return s.count
+}
+
+// Mean returns the exact average of the values in the sketch, rounded down,
+// or 0 if it is empty.
+func (s *Sketch) Mean() uint64 {
+	if s.count <= 0 {
+		return 0
+	}
+	return roundValue(math.Floor(s.sum / s.count))
+}
+
+// Quantile returns the value at quantile q (0 <= q <= 1) of the values in
+// the sketch, or 0 if it is empty.
+func (s *Sketch) Quantile(q float64) uint64 {
+	if s.count <= 0 {
+		return 0
+	}
+	rank := q * s.count
+	acc := s.zero
+	if acc > rank {
+		return 0
+	}
+	last := 0.0
+	for j, c := range s.counts {
+		if c <= 0 {
+			continue
+		}
+		last = sketchValue(s.offset + j)
+		if acc += c; acc > rank {
+			return roundValue(last)
+		}
+	}
+	return roundValue(last)
+}
+
+// sketchIndex returns the bucket of v >= 1.
+func sketchIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue returns the value that represents bucket i, which is within
+// the relative accuracy of every value in the bucket.
+func sketchValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+func roundValue(v float64) uint64 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(math.Round(v))
+}
+
+type sketchJSON struct {
+	Accuracy float64   `json:"accuracy"`
+	Zero     float64   `json:"zero,omitempty"`
+	Offset   int       `json:"offset"`
+	Counts   []float64 `json:"counts,omitempty"`
+	Count    float64   `json:"count"`
+	Sum      float64   `json:"sum"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&sketchJSON{
+		Accuracy: sketchAccuracy,
+		Zero:     s.zero,
+		Offset:   s.offset,
+		Counts:   s.counts,
+		Count:    s.count,
+		Sum:      s.sum,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Sketch) UnmarshalJSON(b []byte) error {
+	var v sketchJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Accuracy != sketchAccuracy {
+		return fmt.Errorf("unsupported sketch accuracy %v", v.Accuracy)
+	}
+	*s = Sketch{
+		zero:   v.Zero,
+		offset: v.Offset,
+		counts: v.Counts,
+		count:  v.Count,
+		sum:    v.Sum,
+	}
+	return nil
+}
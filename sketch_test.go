@@ -0,0 +1,108 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// checkAccuracy fails if got isn't within the sketch's relative accuracy of
+// want.
+func checkAccuracy(t *testing.T, want, got uint64) {
+	t.Helper()
+	if diff := math.Abs(float64(got) - float64(want)); diff > sketchAccuracy*float64(want)+1 {
+		t.Errorf("want %d within %v, got: %d", want, sketchAccuracy, got)
+	}
+}
+
+func TestSketchQuantile(t *testing.T) {
+	t.Parallel()
+
+	var s Sketch
+	if got := s.Quantile(0.5); got != 0 {
+		t.Errorf("empty sketch quantile, want 0, got: %d", got)
+	}
+
+	var vals []uint64
+	for i := uint64(0); i < 1000; i++ {
+		v := i * i
+		vals = append(vals, v)
+		s.Add(v)
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99} {
+		checkAccuracy(t, vals[int(q*float64(len(vals)))], s.Quantile(q))
+	}
+	checkAccuracy(t, vals[len(vals)-1], s.Quantile(1))
+
+	var sum float64
+	for _, v := range vals {
+		sum += float64(v)
+	}
+	if got, want := s.Mean(), uint64(math.Floor(sum/float64(len(vals)))); got != want {
+		t.Errorf("mean, want %d, got: %d", want, got)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	t.Parallel()
+
+	var a, b, all Sketch
+	for i := uint64(1); i <= 100; i++ {
+		a.Add(i)
+		all.Add(i)
+	}
+	for i := uint64(5000); i <= 5100; i++ {
+		b.Add(i)
+		all.Add(i)
+	}
+	b.Add(0)
+	all.Add(0)
+
+	a.Merge(&b)
+	if diff := cmp.Diff(all, a, cmp.AllowUnexported(Sketch{})); diff != "" {
+		t.Errorf("merged sketch mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSketchJSON(t *testing.T) {
+	t.Parallel()
+
+	var s Sketch
+	for _, v := range []uint64{0, 1, 10, 100, 1000} {
+		s.Add(v)
+	}
+	b, err := json.Marshal(&s)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var got Sketch
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(s, got, cmp.AllowUnexported(Sketch{})); diff != "" {
+		t.Errorf("sketch mismatch after round trip (-want, +got):\n%s", diff)
+	}
+
+	if err := json.Unmarshal([]byte(`{"accuracy": 0.05}`), &got); err == nil {
+		t.Errorf("expected error for different accuracy")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"fmt"
+	"time"
+)
+
+// minSlotEntries is the number of requests a time slot needs before its
+// profile is preferred over the profile of all time slots. With fewer, a
+// single request would set the latency of chaff for the whole slot.
+const minSlotEntries = 10
+
+// slotSeparator separates the key and the time slot of a slot history.
+const slotSeparator = "@"
+
+// SlotFunc buckets the time a request is recorded, e.g. by hour of day, so
+// that the tracker can keep a separate profile for each time slot. Chaff
+// requests use the profile of the current time slot.
+//
+// Time slots should have low cardinality, they count towards MaxKeys for every
+// key.
+type SlotFunc func(t time.Time) string
+
+// HourOfDay buckets times by their hour in loc, e.g. "15". If loc is nil, UTC
+// is used.
+func HourOfDay(loc *time.Location) SlotFunc {
+	return func(t time.Time) string {
+		return fmt.Sprintf("%02d", inLocation(t, loc).Hour())
+	}
+}
+
+// DayOfWeek buckets times by their weekday in loc, e.g. "Mon". If loc is nil,
+// UTC is used.
+func DayOfWeek(loc *time.Location) SlotFunc {
+	return func(t time.Time) string {
+		return inLocation(t, loc).Weekday().String()[:3]
+	}
+}
+
+// HourOfWeek buckets times by their weekday and hour in loc, e.g. "Mon15", for
+// traffic with both a daily and weekly cycle. If loc is nil, UTC is used.
+func HourOfWeek(loc *time.Location) SlotFunc {
+	return func(t time.Time) string {
+		t = inLocation(t, loc)
+		return fmt.Sprintf("%s%02d", t.Weekday().String()[:3], t.Hour())
+	}
+}
+
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return t.In(loc)
+}
+
+// WithTimeSlots keeps a separate profile for each time slot returned by fn,
+// for traffic whose latency follows the time of day. Chaff requests use the
+// most specific profile with requests: their key in the current time slot
+// (once it has enough requests), their key, all requests in the current time
+// slot, and finally all requests.
+//
+// A time slot only has a profile while its requests are in the history, so
+// the capacity and window must span the cycle of fn, e.g. a day for
+// HourOfDay. Use WithSnapshotFile to keep them across restarts.
+func WithTimeSlots(fn SlotFunc) Option {
+	return func(t *Tracker) {
+		t.slotFn = fn
+	}
+}
+
+// WithClock sets the clock the tracker uses to record requests, evict them
+// from the window and select time slots, e.g. to test WithTimeSlots. Latency
+// is always measured with the system clock. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(t *Tracker) {
+		t.now = now
+	}
+}
+
+// slotKey returns the key of the history of key in the given time slot. The
+// empty key is the history of all requests in the time slot.
+func slotKey(key, slot string) string {
+	return key + slotSeparator + slot
+}
+
+// profileKeys returns the keys of the histories a profile for key is drawn
+// from, most specific first. The history of all requests is the last resort
+// and isn't included.
+func (t *Tracker) profileKeys(key string, now time.Time) []string {
+	if t.slotFn == nil {
+		if key == "" {
+			return nil
+		}
+		return []string{key}
+	}
+	slot := t.slotFn(now)
+	if key == "" {
+		return []string{slotKey("", slot)}
+	}
+	return []string{slotKey(key, slot), key, slotKey("", slot)}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for WithClock that only moves when set.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestSlotFuncs(t *testing.T) {
+	t.Parallel()
+
+	// A Monday.
+	at := time.Date(2020, 6, 1, 15, 4, 0, 0, time.UTC)
+	est := time.FixedZone("EST", -5*60*60)
+
+	cases := []struct {
+		name string
+		fn   SlotFunc
+		want string
+	}{
+		{"hour of day", HourOfDay(nil), "15"},
+		{"hour of day in location", HourOfDay(est), "10"},
+		{"day of week", DayOfWeek(nil), "Mon"},
+		{"hour of week", HourOfWeek(nil), "Mon15"},
+		{"hour of week in location", HourOfWeek(time.FixedZone("", 10*60*60)), "Tue01"},
+	}
+	for _, tc := range cases {
+		if got := tc.fn(at); got != tc.want {
+			t.Errorf("%s: wrong slot, want: %q, got: %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestTimeSlots(t *testing.T) {
+	t.Parallel()
+
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	quiet, peak := day.Add(3*time.Hour), day.Add(12*time.Hour)
+	clock := &fakeClock{now: peak}
+
+	track := New(WithClock(clock.Now), WithTimeSlots(HourOfDay(nil)), WithKeyFunc(MethodRawPathKey))
+	defer track.Close()
+
+	// Quiet hours are fast, peak hours slow.
+	for i := 0; i < minSlotEntries; i++ {
+		track.recordRequest(&request{key: "GET /", latencyMs: 10, recorded: quiet})
+		track.recordRequest(&request{key: "GET /", latencyMs: 100, recorded: peak})
+		track.recordRequest(&request{key: "GET /other", latencyMs: 50, recorded: peak})
+	}
+	// A single request isn't enough for a slot profile.
+	track.recordRequest(&request{key: "GET /other", latencyMs: 5000, recorded: quiet})
+
+	cases := []struct {
+		name string
+		now  time.Time
+		key  string
+		want uint64
+	}{
+		{"key in slot", quiet, "GET /", 10},
+		{"key in other slot", peak, "GET /", 100},
+		{"key with few requests in slot", quiet, "GET /other", 500},
+		{"all keys in slot", peak, "", 75},
+		{"unknown key in slot", quiet, "GET /unknown", 463},
+		{"no requests in slot", day, "GET /", 55},
+		{"no requests in slot or key", day, "", 212},
+	}
+	for _, tc := range cases {
+		clock.Set(tc.now)
+		if got := track.calculateProfile(tc.key).latencyMs; got != tc.want {
+			t.Errorf("%s: wrong latency, want: %d, got: %d", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: now}
+	track := New(WithClock(clock.Now), WithWindow(time.Minute))
+	defer track.Close()
+
+	track.Record(Observation{Latency: 10 * time.Millisecond, BodySize: 100})
+	waitForRecords(t, track, 1)
+	track.mu.RLock()
+	recorded := track.all.at(0).recorded
+	track.mu.RUnlock()
+	if recorded != now.UnixNano() {
+		t.Errorf("wrong recorded time, want: %v, got: %v", now, time.Unix(0, recorded).UTC())
+	}
+	if got := track.CalculateProfile().bodySize; got != 100 {
+		t.Errorf("wrong body size, want: 100, got: %d", got)
+	}
+
+	// Expiry follows the clock.
+	clock.Set(now.Add(2 * time.Minute))
+	if got := track.CalculateProfile().bodySize; got != 0 {
+		t.Errorf("expected the observation to be outside of the window, got body size: %d", got)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+// Restore also reads snapshots of version 1, which listed every request in
+// full, and rejects other versions.
+const snapshotVersion = 2
+
+type snapshot struct {
+	Version int `json:"version"`
+	// Histories is set by version 2, Records by version 1.
+	Histories []snapshotHistory `json:"histories,omitempty"`
+	Records   []snapshotRecord  `json:"records,omitempty"`
+}
+
+// snapshotHistory is a history of the tracker, the global history has the
+// empty key. Values are the entries that aren't kept in full, all older than
+// the exemplars.
+type snapshotHistory struct {
+	Key       string           `json:"key,omitempty"`
+	Values    []snapshotValue  `json:"values,omitempty"`
+	Exemplars []snapshotRecord `json:"exemplars,omitempty"`
+}
+
+// snapshotValue is a value with short names, since there are up to
+// MaxCapacity of them for each history.
+type snapshotValue struct {
+	Recorded      int64  `json:"t"`
+	LatencyMs     uint64 `json:"l"`
+	HeaderSize    uint64 `json:"h"`
+	BodySize      uint64 `json:"b"`
+	ReqHeaderSize uint64 `json:"rh,omitempty"`
+	ReqBodySize   uint64 `json:"rb,omitempty"`
+	ReqReadMs     uint64 `json:"rr,omitempty"`
+	Load          uint8  `json:"ld,omitempty"`
+}
+
+type snapshotRecord struct {
+	Key               string           `json:"key,omitempty"`
+	Recorded          time.Time        `json:"recorded"`
+	LatencyMs         uint64           `json:"latencyMs"`
+	StatusCode        int              `json:"statusCode"`
+	HeaderSize        uint64           `json:"headerSize"`
+	BodySize          uint64           `json:"bodySize"`
+	Headers           []snapshotHeader `json:"headers,omitempty"`
+	Writes            []WriteEvent     `json:"writes,omitempty"`
+	Encoding          string           `json:"encoding,omitempty"`
+	Shape             *snapshotShape   `json:"shape,omitempty"`
+	RequestHeaderSize uint64           `json:"requestHeaderSize"`
+	RequestBodySize   uint64           `json:"requestBodySize"`
+	RequestReadMs     uint64           `json:"requestReadMs"`
+	Load              uint8            `json:"load,omitempty"`
+}
+
+type snapshotHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Size  int    `json:"size"`
+}
+
+type snapshotShape struct {
+	Kind     jsonKind         `json:"kind"`
+	Size     int              `json:"size,omitempty"`
+	Keys     []string         `json:"keys,omitempty"`
+	Children []*snapshotShape `json:"children,omitempty"`
+}
+
+// Snapshot writes the recorded requests of the tracker to w, so that a new
+// tracker can Restore them, e.g. after a restart. Only what the tracker
+// records is written: sizes, timings, the values of allowlisted headers and
+// the structure of JSON responses.
+func (t *Tracker) Snapshot(w io.Writer) error {
+	t.mu.RLock()
+	s := snapshot{Version: snapshotVersion}
+	s.Histories = append(s.Histories, toSnapshotHistory("", t.all))
+	for key, h := range t.keyed {
+		s.Histories = append(s.Histories, toSnapshotHistory(key, h))
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(s.Histories, func(i, j int) bool {
+		return s.Histories[i].Key < s.Histories[j].Key
+	})
+	if err := json.NewEncoder(w).Encode(&s); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore adds the requests of a snapshot written by Snapshot to the tracker,
+// as if they had been recorded at their original time. Requests that are
+// outside of the tracker's window are evicted.
+func (t *Tracker) Restore(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	switch s.Version {
+	case 1:
+		sort.SliceStable(s.Records, func(i, j int) bool {
+			return s.Records[i].Recorded.Before(s.Records[j].Recorded)
+		})
+		for _, rec := range s.Records {
+			t.recordRequest(fromSnapshotRecord(rec))
+		}
+	case snapshotVersion:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, sh := range s.Histories {
+			h := t.all
+			if sh.Key != "" {
+				if h = t.keyedHistory(sh.Key); h == nil {
+					continue
+				}
+			}
+			for _, v := range sh.Values {
+				h.addValue(fromSnapshotValue(v))
+			}
+			for _, rec := range sh.Exemplars {
+				h.add(fromSnapshotRecord(rec))
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return nil
+}
+
+// validate checks that the records of the snapshot can be served as chaff, so
+// that a corrupt snapshot is rejected before any of it is restored.
+func (s *snapshot) validate() error {
+	for _, rec := range s.Records {
+		if rec.Load >= maxLoadBuckets {
+			return fmt.Errorf("invalid load bucket %d", rec.Load)
+		}
+		if err := rec.Shape.validate(); err != nil {
+			return err
+		}
+	}
+	for _, h := range s.Histories {
+		for _, v := range h.Values {
+			if v.Load >= maxLoadBuckets {
+				return fmt.Errorf("invalid load bucket %d", v.Load)
+			}
+		}
+		for _, rec := range h.Exemplars {
+			if rec.Load >= maxLoadBuckets {
+				return fmt.Errorf("invalid load bucket %d", rec.Load)
+			}
+			if err := rec.Shape.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks that the shape is well-formed, e.g. that objects have a key
+// for every child.
+func (s *snapshotShape) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Size < 0 || s.Size > MaxRandomBytes {
+		return fmt.Errorf("invalid JSON shape: size %d out of range", s.Size)
+	}
+	switch s.Kind {
+	case jsonNull, jsonBool, jsonNumber, jsonString:
+		if len(s.Keys) > 0 || len(s.Children) > 0 {
+			return fmt.Errorf("invalid JSON shape: kind %d has children", s.Kind)
+		}
+	case jsonArray:
+		if len(s.Keys) > 0 {
+			return fmt.Errorf("invalid JSON shape: array has keys")
+		}
+	case jsonObject:
+		if len(s.Keys) != len(s.Children) {
+			return fmt.Errorf("invalid JSON shape: object has %d keys for %d children", len(s.Keys), len(s.Children))
+		}
+	default:
+		return fmt.Errorf("invalid JSON shape: unknown kind %d", s.Kind)
+	}
+	for _, c := range s.Children {
+		if c == nil {
+			return fmt.Errorf("invalid JSON shape: missing child")
+		}
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotFileError is an error restoring the snapshot of WithSnapshotFile.
+type snapshotFileError struct {
+	err error
+}
+
+func (e *snapshotFileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *snapshotFileError) Unwrap() error {
+	return e.err
+}
+
+// WithSnapshotFile restores the tracker from the snapshot at path when it is
+// created. A missing file is ignored, so the same path can be used to write
+// snapshots with Tracker.Snapshot, e.g. on shutdown.
+func WithSnapshotFile(path string) Option {
+	return func(t *Tracker) {
+		t.snapshotPath = path
+	}
+}
+
+// WithBaseline sets the profile of chaff responses while no requests are
+// recorded, e.g. right after a deploy. Header values are recorded like those
+// of real responses, respecting the allowlist and denylist.
+func WithBaseline(p Profile) Option {
+	return func(t *Tracker) {
+		t.baselineProfile = &p
+	}
+}
+
+// restoreFile restores the snapshot at path, if it exists.
+func (t *Tracker) restoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &snapshotFileError{fmt.Errorf("opening snapshot: %w", err)}
+	}
+	defer f.Close()
+	if err := t.Restore(f); err != nil {
+		return &snapshotFileError{err}
+	}
+	return nil
+}
+
+// baselineRequest converts the profile of WithBaseline into a record.
+func (t *Tracker) baselineRequest(p Profile) *request {
+	size := p.HeaderSize
+	if hs := headerSize(p.Header); size < hs {
+		size = hs
+	}
+	record := &request{
+		latencyMs:  uint64(p.Latency.Milliseconds()),
+		headerSize: size,
+		bodySize:   p.BodySize,
+		statusCode: http.StatusOK,
+		headers:    t.recordHeaders(p.Header),
+	}
+	if len(paddableHeaders(record.headers)) == 0 {
+		record.padHeader = spareHeader([]*request{record})
+	}
+	return record
+}
+
+func toSnapshotHistory(key string, h *history) snapshotHistory {
+	sh := snapshotHistory{Key: key}
+	for i := 0; i < h.count()-len(h.exemplars); i++ {
+		sh.Values = append(sh.Values, toSnapshotValue(h.at(i)))
+	}
+	for _, r := range h.exemplars {
+		sh.Exemplars = append(sh.Exemplars, toSnapshotRecord(r))
+	}
+	return sh
+}
+
+func toSnapshotValue(v value) snapshotValue {
+	return snapshotValue{
+		Recorded:      v.recorded,
+		LatencyMs:     v.latencyMs,
+		HeaderSize:    v.headerSize,
+		BodySize:      v.bodySize,
+		ReqHeaderSize: v.reqHeaderSize,
+		ReqBodySize:   v.reqBodySize,
+		ReqReadMs:     v.reqReadMs,
+		Load:          v.load,
+	}
+}
+
+func fromSnapshotValue(v snapshotValue) value {
+	return value{
+		recorded:      v.Recorded,
+		latencyMs:     v.LatencyMs,
+		headerSize:    v.HeaderSize,
+		bodySize:      v.BodySize,
+		reqHeaderSize: v.ReqHeaderSize,
+		reqBodySize:   v.ReqBodySize,
+		reqReadMs:     v.ReqReadMs,
+		load:          v.Load,
+	}
+}
+
+func toSnapshotRecord(r *request) snapshotRecord {
+	rec := snapshotRecord{
+		Key:               r.key,
+		Recorded:          r.recorded,
+		LatencyMs:         r.latencyMs,
+		StatusCode:        r.statusCode,
+		HeaderSize:        r.headerSize,
+		BodySize:          r.bodySize,
+		Writes:            r.writes,
+		Encoding:          r.encoding,
+		Shape:             toSnapshotShape(r.shape),
+		RequestHeaderSize: r.reqHeaderSize,
+		RequestBodySize:   r.reqBodySize,
+		RequestReadMs:     r.reqReadMs,
+		Load:              r.load,
+	}
+	for _, f := range r.headers {
+		rec.Headers = append(rec.Headers, snapshotHeader{Name: f.name, Value: f.value, Size: f.size})
+	}
+	return rec
+}
+
+func fromSnapshotRecord(rec snapshotRecord) *request {
+	r := &request{
+		key:           rec.Key,
+		recorded:      rec.Recorded,
+		latencyMs:     rec.LatencyMs,
+		statusCode:    rec.StatusCode,
+		headerSize:    rec.HeaderSize,
+		bodySize:      rec.BodySize,
+		writes:        rec.Writes,
+		encoding:      rec.Encoding,
+		shape:         fromSnapshotShape(rec.Shape),
+		reqHeaderSize: rec.RequestHeaderSize,
+		reqBodySize:   rec.RequestBodySize,
+		reqReadMs:     rec.RequestReadMs,
+		load:          rec.Load,
+	}
+	for _, h := range rec.Headers {
+		r.headers = append(r.headers, headerField{name: http.CanonicalHeaderKey(h.Name), value: h.Value, size: h.Size})
+	}
+	return r
+}
+
+func toSnapshotShape(s *jsonShape) *snapshotShape {
+	if s == nil {
+		return nil
+	}
+	out := &snapshotShape{Kind: s.kind, Size: s.size, Keys: s.keys}
+	for _, c := range s.children {
+		out.Children = append(out.Children, toSnapshotShape(c))
+	}
+	return out
+}
+
+func fromSnapshotShape(s *snapshotShape) *jsonShape {
+	if s == nil {
+		return nil
+	}
+	out := &jsonShape{kind: s.Kind, size: s.Size, keys: s.Keys}
+	for _, c := range s.Children {
+		out.children = append(out.children, fromSnapshotShape(c))
+	}
+	return out
+}
@@ -0,0 +1,269 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	records := []*request{
+		{
+			key:        "GET /a",
+			recorded:   now.Add(-2 * time.Second),
+			latencyMs:  25,
+			statusCode: http.StatusOK,
+			headerSize: 100,
+			bodySize:   250,
+			headers: []headerField{
+				{name: "Content-Type", value: "application/json", size: 16},
+				{name: "X-Request-Id", size: 20},
+			},
+			writes:   []WriteEvent{{Offset: time.Millisecond, Size: 250, Flush: true}},
+			encoding: "gzip",
+			shape: &jsonShape{kind: jsonObject, keys: []string{"id"}, children: []*jsonShape{
+				{kind: jsonString, size: 8},
+			}},
+			reqHeaderSize: 40,
+			reqBodySize:   10,
+			reqReadMs:     1,
+			load:          2,
+		},
+		{
+			recorded:   now.Add(-time.Second),
+			latencyMs:  50,
+			statusCode: http.StatusNotFound,
+			headerSize: 20,
+			bodySize:   30,
+		},
+	}
+
+	src := New(WithKeyFunc(MethodRawPathKey))
+	defer src.Close()
+	for _, r := range records {
+		src.recordRequest(r)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if strings.Contains(buf.String(), `"body"`) {
+		t.Errorf("snapshot contains response bodies: %s", buf.String())
+	}
+
+	dst := New(WithKeyFunc(MethodRawPathKey))
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	opts := cmp.Options{cmp.AllowUnexported(request{}, headerField{}, jsonShape{})}
+	if diff := cmp.Diff(records, dst.all.exemplars, opts); diff != "" {
+		t.Errorf("restored records mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(records[:1], dst.keyed["GET /a"].exemplars, opts); diff != "" {
+		t.Errorf("restored keyed records mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSnapshotValues(t *testing.T) {
+	t.Parallel()
+
+	src := New()
+	defer src.Close()
+	now := time.Now()
+	for i := uint64(0); i < 3*DefaultCapacity; i++ {
+		src.recordRequest(&request{recorded: now, latencyMs: i, bodySize: i, reqReadMs: 1, reqBodySize: 10, load: loadBucket(int64(i))})
+	}
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	dst := New()
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	opts := cmp.Options{cmp.AllowUnexported(Sketch{})}
+	if diff := cmp.Diff(bodySizes(src.all), bodySizes(dst.all)); diff != "" {
+		t.Errorf("restored values mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(src.all.resp, dst.all.resp, opts); diff != "" {
+		t.Errorf("restored distribution mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(src.all.load, dst.all.load, opts); diff != "" {
+		t.Errorf("restored load distribution mismatch (-want, +got):\n%s", diff)
+	}
+	if got, want := dst.all.readBytes, src.all.readBytes; got != want {
+		t.Errorf("restored read bytes, want: %v, got: %v", want, got)
+	}
+}
+
+func TestRestoreVersion1(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithKeyFunc(MethodRawPathKey))
+	defer track.Close()
+
+	v1 := `{"version": 1, "records": [
+		{"key": "GET /a", "recorded": "2020-01-01T00:00:00Z", "latencyMs": 10, "statusCode": 200, "bodySize": 100},
+		{"recorded": "2020-01-01T00:00:01Z", "latencyMs": 30, "statusCode": 200, "bodySize": 300}
+	]}`
+	if err := track.Restore(strings.NewReader(v1)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := bodySizes(track.all); len(got) != 2 || got[0] != 100 || got[1] != 300 {
+		t.Errorf("wrong records, want: [100 300], got: %v", got)
+	}
+	if got := bodySizes(track.keyed["GET /a"]); len(got) != 1 || got[0] != 100 {
+		t.Errorf("wrong keyed records, want: [100], got: %v", got)
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	if err := track.Restore(strings.NewReader(`{"version": 3, "histories": []}`)); err == nil {
+		t.Errorf("expected error for unsupported version")
+	}
+	if err := track.Restore(strings.NewReader(`{"version": 1`)); err == nil {
+		t.Errorf("expected error for truncated snapshot")
+	}
+}
+
+func TestWithSnapshotFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "chaff")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "snapshot.json")
+
+	// A missing file is not an error.
+	empty, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithSnapshotFile(path))
+	if err != nil {
+		t.Fatalf("NewTracker with missing snapshot: %v", err)
+	}
+	empty.recordRequest(&request{recorded: time.Now(), latencyMs: 10, bodySize: 100, statusCode: http.StatusOK})
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create: %v", err)
+	}
+	if err := empty.Snapshot(f); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	f.Close()
+	empty.Close()
+
+	track, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithSnapshotFile(path))
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	defer track.Close()
+	if got := track.CalculateProfile().bodySize; got != 100 {
+		t.Errorf("restored profile has body size %d, want 100", got)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithSnapshotFile(path)); err == nil {
+		t.Errorf("expected error for corrupt snapshot")
+	}
+
+	// New starts empty instead.
+	fallback := New(WithSnapshotFile(path))
+	defer fallback.Close()
+	if got := fallback.CalculateProfile().bodySize; got != 0 {
+		t.Errorf("expected empty profile, got body size %d", got)
+	}
+}
+
+func TestRestoreInvalidShape(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"more children than keys": `{"kind": 5, "keys": ["a"], "children": [{"kind": 0}, {"kind": 0}]}`,
+		"unknown kind":            `{"kind": 42}`,
+		"negative size":           `{"kind": 3, "size": -1}`,
+		"scalar with children":    `{"kind": 3, "children": [{"kind": 0}]}`,
+		"array with keys":         `{"kind": 4, "keys": ["a"], "children": [{"kind": 0}]}`,
+		"missing child":           `{"kind": 4, "children": [null]}`,
+		"invalid nested shape":    `{"kind": 4, "children": [{"kind": 42}]}`,
+	}
+	for name, shape := range cases {
+		track := New()
+		defer track.Close()
+
+		snapshot := `{"version": 2, "histories": [{"exemplars": [{"recorded": "2020-06-01T00:00:00Z", "shape": ` + shape + `}]}]}`
+		if err := track.Restore(strings.NewReader(snapshot)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		if got := track.all.count(); got != 0 {
+			t.Errorf("%s: restored %d records from an invalid snapshot", name, got)
+		}
+	}
+}
+
+func TestWithBaseline(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithBaseline(Profile{
+		Latency:    30 * time.Millisecond,
+		Header:     http.Header{"X-Request-Id": []string{"0123456789"}},
+		HeaderSize: 60,
+		BodySize:   500,
+	}))
+	defer track.Close()
+
+	got := track.CalculateProfile()
+	want := &request{
+		latencyMs:  30,
+		headerSize: 60,
+		bodySize:   500,
+		statusCode: http.StatusOK,
+		headers:    []headerField{{name: "X-Request-Id", size: 10}},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(request{}, headerField{})); diff != "" {
+		t.Errorf("baseline profile mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Recorded requests take precedence.
+	track.recordRequest(&request{recorded: time.Now(), latencyMs: 10, bodySize: 100, statusCode: http.StatusOK})
+	if got := track.CalculateProfile().bodySize; got != 100 {
+		t.Errorf("profile has body size %d, want 100", got)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Distribution is the distribution of the latency and sizes of the responses
+// recorded for a key.
+type Distribution struct {
+	Latency    *Sketch `json:"latency"`
+	HeaderSize *Sketch `json:"headerSize"`
+	BodySize   *Sketch `json:"bodySize"`
+}
+
+func newDistribution() *Distribution {
+	return &Distribution{
+		Latency:    &Sketch{},
+		HeaderSize: &Sketch{},
+		BodySize:   &Sketch{},
+	}
+}
+
+// scale multiplies the weight of all values in the distribution by f.
+func (d *Distribution) scale(f float64) {
+	d.Latency.scale(f)
+	d.HeaderSize.scale(f)
+	d.BodySize.scale(f)
+}
+
+// empty reports whether the distribution has no values to draw from.
+func (d *Distribution) empty() bool {
+	return d == nil || d.Latency == nil || d.HeaderSize == nil || d.BodySize == nil ||
+		d.Latency.Count() <= 0
+}
+
+// Merge adds the values of o to the distribution.
+func (d *Distribution) Merge(o *Distribution) {
+	if o == nil {
+		return
+	}
+	d.Latency.Merge(o.Latency)
+	d.HeaderSize.Merge(o.HeaderSize)
+	d.BodySize.Merge(o.BodySize)
+}
+
+// Summary is the aggregated profile of the requests recorded by one or more
+// trackers.
+type Summary struct {
+	// Keys holds the distribution of each key. The global distribution of all
+	// requests has the empty key.
+	Keys map[string]*Distribution `json:"keys"`
+	// Updated is when the summary was created. Stores use it to expire
+	// summaries of replicas that stopped pushing.
+	Updated time.Time `json:"updated"`
+}
+
+// NewSummary creates an empty summary.
+func NewSummary() *Summary {
+	return &Summary{Keys: make(map[string]*Distribution)}
+}
+
+// Merge adds the distributions of o to the summary, so that the summary
+// describes the requests of both. The later update time is kept.
+func (s *Summary) Merge(o *Summary) {
+	if o == nil {
+		return
+	}
+	if s.Keys == nil {
+		s.Keys = make(map[string]*Distribution, len(o.Keys))
+	}
+	for k, od := range o.Keys {
+		d, ok := s.Keys[k]
+		if !ok {
+			d = newDistribution()
+			s.Keys[k] = d
+		}
+		d.Merge(od)
+	}
+	if o.Updated.After(s.Updated) {
+		s.Updated = o.Updated
+	}
+}
+
+// distribution returns the distribution of key, falling back to the global
+// distribution like Tracker does for recorded requests. It returns nil if
+// neither has any values.
+func (s *Summary) distribution(key string) *Distribution {
+	if s == nil {
+		return nil
+	}
+	if key != "" {
+		if d := s.Keys[key]; !d.empty() {
+			return d
+		}
+	}
+	if d := s.Keys[""]; !d.empty() {
+		return d
+	}
+	return nil
+}
+
+// ProfileStore shares the profiles of trackers across replicas. Each replica
+// periodically pushes a summary of what it recorded and pulls the merged
+// summary of all replicas, so that all replicas serve chaff like the fleet
+// as a whole. Implementations must be safe for concurrent use.
+type ProfileStore interface {
+	// Push replaces the summary of the replica.
+	Push(ctx context.Context, replica string, s *Summary) error
+	// Pull returns the merged summary of all replicas.
+	Pull(ctx context.Context) (*Summary, error)
+}
+
+var _ ProfileStore = (*MemoryStore)(nil)
+
+// MemoryStore is a ProfileStore for trackers in the same process, e.g. one
+// per listener.
+type MemoryStore struct {
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	summaries map[string]*Summary
+}
+
+// NewMemoryStore creates a store that merges the summaries updated within
+// maxAge. If maxAge is 0, summaries never expire.
+func NewMemoryStore(maxAge time.Duration) *MemoryStore {
+	return &MemoryStore{
+		maxAge:    maxAge,
+		summaries: make(map[string]*Summary),
+	}
+}
+
+// Push implements ProfileStore.
+func (m *MemoryStore) Push(_ context.Context, replica string, s *Summary) error {
+	// Copy the summary, the caller keeps ownership of s.
+	c := NewSummary()
+	c.Merge(s)
+	c.Updated = s.Updated
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summaries[replica] = c
+	return nil
+}
+
+// Pull implements ProfileStore.
+func (m *MemoryStore) Pull(_ context.Context) (*Summary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	merged := NewSummary()
+	for replica, s := range m.summaries {
+		if expired(s, m.maxAge) {
+			delete(m.summaries, replica)
+			continue
+		}
+		merged.Merge(s)
+	}
+	return merged, nil
+}
+
+var _ ProfileStore = (*FileStore)(nil)
+
+// FileStore is a ProfileStore that keeps the summary of each replica in a
+// file in a shared directory, e.g. a volume mounted by all replicas.
+type FileStore struct {
+	dir    string
+	maxAge time.Duration
+}
+
+// fileStoreExt is the extension of summary files in a FileStore.
+const fileStoreExt = ".json"
+
+// NewFileStore creates a store in dir that merges the summaries updated
+// within maxAge. If maxAge is 0, summaries never expire.
+func NewFileStore(dir string, maxAge time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+	return &FileStore{dir: dir, maxAge: maxAge}, nil
+}
+
+// Push implements ProfileStore. The summary is written to a temporary file
+// and renamed, so that Pull never reads a partial summary.
+func (f *FileStore) Push(_ context.Context, replica string, s *Summary) error {
+	if replica == "" {
+		return fmt.Errorf("replica must be non-empty")
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding summary: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".summary-*")
+	if err != nil {
+		return fmt.Errorf("creating summary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing summary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing summary file: %w", err)
+	}
+
+	path := filepath.Join(f.dir, url.PathEscape(replica)+fileStoreExt)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing summary file: %w", err)
+	}
+	return nil
+}
+
+// Pull implements ProfileStore. Files of replicas that haven't pushed within
+// maxAge are ignored, but not removed.
+func (f *FileStore) Pull(_ context.Context) (*Summary, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing summary files: %w", err)
+	}
+
+	merged := NewSummary()
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), fileStoreExt) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(f.dir, fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("reading summary file: %w", err)
+		}
+		var s Summary
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("decoding summary file %v: %w", fi.Name(), err)
+		}
+		if expired(&s, f.maxAge) {
+			continue
+		}
+		merged.Merge(&s)
+	}
+	return merged, nil
+}
+
+func expired(s *Summary, maxAge time.Duration) bool {
+	return maxAge > 0 && time.Since(s.Updated) > maxAge
+}
+
+// WithProfileStore shares the tracker's profiles through store. Every
+// interval, the tracker pushes a summary of the requests it recorded as the
+// given replica, then pulls the merged summary of all replicas. Chaff latency
+// and sizes are then drawn from the fleet's distributions using the tracker's
+// ProfileStrategy, while the status code, headers and body structure still
+// come from local requests. Errors are logged and retried on the next
+// interval.
+func WithProfileStore(store ProfileStore, replica string, interval time.Duration) Option {
+	return func(t *Tracker) {
+		t.store = store
+		t.replica = replica
+		t.syncInterval = interval
+	}
+}
+
+// syncStore pushes to and pulls from the profile store until the tracker is
+// closed. The fleet profile is pulled once right away, so that a new replica
+// doesn't wait for its first interval.
+func (t *Tracker) syncStore() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-t.shutdown
+		cancel()
+	}()
+
+	t.pullStore(ctx)
+
+	ticker := time.NewTicker(t.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.store.Push(ctx, t.replica, t.Summary()); err != nil {
+				log.Printf("error pushing chaff profile: %v", err)
+			}
+			t.pullStore(ctx)
+		case <-t.shutdown:
+			return
+		}
+	}
+}
+
+func (t *Tracker) pullStore(ctx context.Context) {
+	fleet, err := t.store.Pull(ctx)
+	if err != nil {
+		log.Printf("error pulling chaff profile: %v", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fleet = fleet
+}
+
+// Summary returns the distributions of the requests recorded by the tracker,
+// globally and for each key.
+func (t *Tracker) Summary() *Summary {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := t.now()
+	s := NewSummary()
+	s.Updated = now
+	add := func(key string, h *history) {
+		if h.empty(now) {
+			return
+		}
+		s.Keys[key] = h.distribution(now)
+	}
+	add("", t.all)
+	for key, h := range t.keyed {
+		add(key, h)
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func testSummary(updated time.Time, bodySizes ...uint64) *Summary {
+	s := NewSummary()
+	s.Updated = updated
+	d := newDistribution()
+	for _, size := range bodySizes {
+		d.Latency.Add(10)
+		d.HeaderSize.Add(50)
+		d.BodySize.Add(size)
+	}
+	s.Keys[""] = d
+	return s
+}
+
+func testStore(t *testing.T, store ProfileStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := store.Push(ctx, "a", testSummary(time.Now(), 100, 100)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if err := store.Push(ctx, "b/1", testSummary(time.Now(), 400)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	// Pushing again replaces the replica's summary.
+	if err := store.Push(ctx, "a", testSummary(time.Now(), 100)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	// Expired summaries are ignored.
+	if err := store.Push(ctx, "old", testSummary(time.Now().Add(-time.Hour), 10000)); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	s, err := store.Pull(ctx)
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	d := s.distribution("")
+	if d == nil {
+		t.Fatalf("missing global distribution in %v", s)
+	}
+	if got := d.BodySize.Count(); got != 2 {
+		t.Errorf("merged count, want 2, got: %v", got)
+	}
+	if got := d.BodySize.Mean(); got != 250 {
+		t.Errorf("merged mean, want 250, got: %d", got)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	testStore(t, NewMemoryStore(time.Minute))
+}
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "chaff")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewFileStore(dir, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	testStore(t, store)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected one file per replica, got: %d", len(files))
+	}
+}
+
+func TestProfileStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore(0)
+	busy, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithProfileStore(store, "busy", 5*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	defer busy.Close()
+	quiet, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithProfileStore(store, "quiet", 5*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	defer quiet.Close()
+
+	for i := 0; i < 3; i++ {
+		busy.recordRequest(&request{recorded: time.Now(), latencyMs: 10, bodySize: 1000, statusCode: http.StatusOK})
+	}
+	quiet.recordRequest(&request{recorded: time.Now(), latencyMs: 10, bodySize: 200, statusCode: http.StatusCreated})
+
+	// Both trackers converge on the mean of all four requests, the status
+	// code still comes from local requests.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, q := busy.CalculateProfile(), quiet.CalculateProfile()
+		if b.bodySize == 800 && q.bodySize == 800 {
+			if q.statusCode != http.StatusCreated {
+				t.Errorf("status code of quiet replica, want %d, got: %d", http.StatusCreated, q.statusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("profiles did not converge, got: %d and %d", b.bodySize, q.bodySize)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := NewTracker(&PlainResponder{}, DefaultCapacity, WithProfileStore(store, "c", 0)); err == nil {
+		t.Errorf("expected error for zero interval")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import "github.com/mikehelmick/go-chaff/internal/random"
+
+// ProfileStrategy determines how the profile for a single chaff response is
+// derived from the recorded history of real requests.
+type ProfileStrategy int
+
+const (
+	// MeanStrategy uses the average latency and sizes across all recorded
+	// requests. Every chaff response has the same shape. This is the default.
+	MeanStrategy ProfileStrategy = iota
+
+	// SampleStrategy replays the latency and sizes of a single, randomly
+	// selected recorded request.
+	SampleStrategy
+
+	// PercentileStrategy draws a random percentile and uses the latency and
+	// sizes at that percentile of the recorded distribution, accurate to
+	// within 1%. This produces values that follow the real distribution
+	// without repeating exact recorded values.
+	PercentileStrategy
+)
+
+// profile applies the strategy to the history, which must not be empty.
+//
+// Regardless of strategy, the status code, encoding, JSON structure and write
+// cadence are taken from a randomly selected recent request so that chaff
+// mirrors the real mix of responses.
+func (s ProfileStrategy) profile(h *history) *request {
+	var profile *request
+	var r *request
+	switch s {
+	case SampleStrategy:
+		var v value
+		v, r = h.sample()
+		profile = &request{
+			latencyMs:  v.latencyMs,
+			headerSize: v.headerSize,
+			bodySize:   v.bodySize,
+		}
+	default:
+		r = h.exemplar()
+		profile = &request{}
+		profile.latencyMs, profile.headerSize, profile.bodySize = s.draw(h.resp)
+	}
+	profile.statusCode = r.statusCode
+	profile.encoding = r.encoding
+	profile.shape = r.shape
+	if s == SampleStrategy && r.headerSize == profile.headerSize {
+		// Replay the headers of the sampled request.
+		profile.headers = r.headers
+	} else {
+		profile.headers = headerTemplate(h.exemplars, profile.headerSize)
+	}
+	profile.writes = scaleWrites(r.writes, r.bodySize, profile.bodySize, r.latencyMs, profile.latencyMs)
+	return profile
+}
+
+// draw applies the strategy to a distribution. Sketches don't keep individual
+// requests, so SampleStrategy draws a single quantile for all values like
+// PercentileStrategy.
+func (s ProfileStrategy) draw(d *Distribution) (latencyMs, headerSize, bodySize uint64) {
+	switch s {
+	case SampleStrategy, PercentileStrategy:
+		p := random.Float()
+		return d.Latency.Quantile(p), d.HeaderSize.Quantile(p), d.BodySize.Quantile(p)
+	default:
+		return d.Latency.Mean(), d.HeaderSize.Mean(), d.BodySize.Mean()
+	}
+}
+
+// drawLatency draws a latency from s, like draw.
+func (s ProfileStrategy) drawLatency(sk *Sketch) uint64 {
+	switch s {
+	case SampleStrategy, PercentileStrategy:
+		return sk.Quantile(random.Float())
+	default:
+		return sk.Mean()
+	}
+}
+
+// headerTemplate selects the header set of the largest recorded response
+// headers that still fit within headerSize, the remainder is left for padding.
+// Ties are broken randomly.
+func headerTemplate(records []*request, headerSize uint64) []headerField {
+	var candidates []*request
+	for _, r := range records {
+		if r.headerSize > headerSize {
+			continue
+		}
+		if len(candidates) > 0 && r.headerSize < candidates[0].headerSize {
+			continue
+		}
+		if len(candidates) > 0 && r.headerSize > candidates[0].headerSize {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[random.Index(len(candidates))].headers
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMeanStrategy(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	track.recordRequest(&request{latencyMs: 10, bodySize: 100, headerSize: 10, statusCode: 200})
+	track.recordRequest(&request{latencyMs: 30, bodySize: 300, headerSize: 30, statusCode: 200})
+
+	want := &request{latencyMs: 20, bodySize: 200, headerSize: 20, statusCode: 200}
+	for i := 0; i < 10; i++ {
+		got := track.CalculateProfile()
+		if diff := cmp.Diff(want, got, cmp.AllowUnexported(request{})); diff != "" {
+			t.Fatalf("mismatch (-want, +got):\n%s", diff)
+		}
+	}
+}
+
+func TestSampleStrategy(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithProfileStrategy(SampleStrategy))
+	defer track.Close()
+
+	records := []*request{
+		{latencyMs: 10, bodySize: 100, headerSize: 10, statusCode: 200},
+		{latencyMs: 20, bodySize: 200, headerSize: 20, statusCode: 200},
+		{latencyMs: 30, bodySize: 300, headerSize: 30, statusCode: 200},
+	}
+	for _, r := range records {
+		track.recordRequest(r)
+	}
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 200; i++ {
+		got := track.CalculateProfile()
+		found := false
+		for _, r := range records {
+			if cmp.Equal(r, got, cmp.AllowUnexported(request{})) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("profile %+v is not a recorded request", got)
+		}
+		seen[got.latencyMs] = true
+	}
+	if len(seen) != len(records) {
+		t.Errorf("expected all %d records to be sampled, got %d", len(records), len(seen))
+	}
+}
+
+func TestPercentileStrategy(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithProfileStrategy(PercentileStrategy), WithMaxLatency(90))
+	defer track.Close()
+
+	for i := uint64(0); i <= 10; i++ {
+		track.recordRequest(&request{latencyMs: i * 10, bodySize: i * 100, headerSize: i})
+	}
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 200; i++ {
+		got := track.CalculateProfile()
+		if got.latencyMs > 90 {
+			t.Fatalf("latency %v exceeds max latency", got.latencyMs)
+		}
+		// Percentiles are accurate to within the relative accuracy of the
+		// sketch.
+		if got.bodySize > 1000*(1+sketchAccuracy) {
+			t.Fatalf("body size %v outside of recorded range", got.bodySize)
+		}
+		if got.headerSize > 10 {
+			t.Fatalf("header size %v outside of recorded range", got.headerSize)
+		}
+		seen[got.bodySize] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("expected varied profiles, got %d distinct body sizes", len(seen))
+	}
+}
+
+func TestStatusCodeDistribution(t *testing.T) {
+	t.Parallel()
+
+	for _, strategy := range []ProfileStrategy{MeanStrategy, SampleStrategy, PercentileStrategy} {
+		track := New(WithProfileStrategy(strategy))
+		defer track.Close()
+
+		for i := 0; i < 10; i++ {
+			code := http.StatusOK
+			if i%2 == 0 {
+				code = http.StatusNotFound
+			}
+			track.recordRequest(&request{bodySize: 100, statusCode: code})
+		}
+
+		counts := make(map[int]int)
+		for i := 0; i < 200; i++ {
+			w := httptest.NewRecorder()
+			track.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			counts[w.Code]++
+		}
+
+		if len(counts) != 2 || counts[http.StatusOK] == 0 || counts[http.StatusNotFound] == 0 {
+			t.Errorf("strategy %d: expected a mix of 200 and 404, got: %v", strategy, counts)
+		}
+	}
+}
+
+func TestNoBodyStatusCode(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	track.recordRequest(&request{bodySize: 100, statusCode: http.StatusNoContent})
+
+	w := httptest.NewRecorder()
+	track.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("wrong code, want: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no body, got %d bytes", w.Body.Len())
+	}
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	t.Parallel()
+
+	small := []headerField{{name: "Vary", value: "Accept", size: 6}}
+	large := []headerField{{name: "Set-Cookie", size: 500}}
+	records := []*request{
+		{headerSize: 10, headers: small},
+		{headerSize: 510, headers: large},
+	}
+
+	if got := headerTemplate(records, 300); !cmp.Equal(small, got, cmp.AllowUnexported(headerField{})) {
+		t.Errorf("expected small header set, got: %v", got)
+	}
+	if got := headerTemplate(records, 510); !cmp.Equal(large, got, cmp.AllowUnexported(headerField{})) {
+		t.Errorf("expected large header set, got: %v", got)
+	}
+	if got := headerTemplate(records, 5); got != nil {
+		t.Errorf("expected no header set, got: %v", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+// maxWriteEvents is the maximum number of writes recorded per request. Later
+// writes are merged into the last recorded write.
+const maxWriteEvents = 64
+
+// WriteEvent describes a single write of a response body. The offset of the
+// first event is the handler's time to first byte.
+type WriteEvent struct {
+	// Offset is the time since the handler started.
+	Offset time.Duration
+	// Size is the number of bytes written.
+	Size uint64
+	// Flush indicates the handler flushed the response after this write.
+	Flush bool
+}
+
+// StreamResponder is a Responder that can replay the write cadence of real
+// responses. If the tracker's responder implements StreamResponder,
+// WriteStream is called instead of Write.
+type StreamResponder interface {
+	Responder
+
+	// WriteStream writes the status code and the appropriately sized header,
+	// then the body following the given writes. The sizes of all writes add up
+	// to the body size.
+	WriteStream(statusCode int, headerSize uint64, writes []WriteEvent, w http.ResponseWriter, r *http.Request) error
+}
+
+var _ StreamResponder = (*StreamingResponder)(nil)
+
+// StreamingResponder writes random data like the PlainResponder, but
+// reproduces the time to first byte and the write and flush cadence of real
+// responses. Flushed responses use chunked transfer encoding, so the packet
+// timing matches streaming handlers.
+type StreamingResponder struct {
+	PlainResponder
+}
+
+func (sr *StreamingResponder) WriteStream(statusCode int, headerSize uint64, writes []WriteEvent, w http.ResponseWriter, r *http.Request) error {
+	PadHeaders(w, r, headerSize)
+	if !BodyAllowedForStatus(statusCode) {
+		w.WriteHeader(statusCode)
+		return nil
+	}
+
+	flusher, _ := w.(http.Flusher)
+	start := time.Now()
+	wroteHeader := false
+	for _, e := range writes {
+		if !sleepUntil(r, start.Add(e.Offset)) {
+			return r.Context().Err()
+		}
+		if !wroteHeader {
+			w.WriteHeader(statusCode)
+			wroteHeader = true
+		}
+		if e.Size > 0 {
+			if _, err := w.Write([]byte(random.String(int(e.Size)))); err != nil {
+				return err
+			}
+		}
+		if e.Flush && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if !wroteHeader {
+		w.WriteHeader(statusCode)
+	}
+	return nil
+}
+
+// sleepUntil waits until the deadline or the request is cancelled, reporting
+// whether the deadline was reached.
+func sleepUntil(r *http.Request, deadline time.Time) bool {
+	d := time.Until(deadline)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// scaleWrites adjusts recorded writes to a different body size and latency.
+// Write sizes are scaled proportionally so they add up to toSize, offsets are
+// scaled to fit within toMs.
+func scaleWrites(writes []WriteEvent, fromSize, toSize, fromMs, toMs uint64) []WriteEvent {
+	if len(writes) == 0 || fromSize == 0 {
+		return nil
+	}
+
+	scaled := make([]WriteEvent, len(writes))
+	var total uint64
+	for i, e := range writes {
+		scaled[i] = e
+		scaled[i].Size = uint64(float64(e.Size) * float64(toSize) / float64(fromSize))
+		total += scaled[i].Size
+		if fromMs > 0 {
+			scaled[i].Offset = time.Duration(float64(e.Offset) * float64(toMs) / float64(fromMs))
+		}
+	}
+	// Correct rounding errors on the last write.
+	last := &scaled[len(scaled)-1]
+	last.Size = last.Size + toSize - total
+	return scaled
+}
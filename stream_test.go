@@ -0,0 +1,155 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStreamingResponder(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker(&StreamingResponder{}, DefaultCapacity, WithProfileStrategy(SampleStrategy))
+	if err != nil {
+		t.Fatalf("error creating tracker: %v", err)
+	}
+	defer tracker.Close()
+
+	srv := httptest.NewServer(tracker.HandleTrack(HeaderDetector(Header),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 3; i++ {
+				w.Write([]byte(strings.Repeat("s", 100)))
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		})))
+	defer srv.Close()
+
+	// fetch returns the time to first byte, the total time and the body size.
+	fetch := func(chaff bool) (time.Duration, time.Duration, int) {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		if chaff {
+			req.Header.Set(Header, "1")
+		}
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if got := resp.TransferEncoding; len(got) != 1 || got[0] != "chunked" {
+			t.Errorf("expected chunked response, got: %v", got)
+		}
+
+		var ttfb time.Duration
+		size := 0
+		buf := make([]byte, 10)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 && size == 0 {
+				ttfb = time.Since(start)
+			}
+			size += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("error reading body: %v", err)
+			}
+		}
+		return ttfb, time.Since(start), size
+	}
+
+	fetch(false)
+	waitForRecords(t, tracker, 1)
+
+	ttfb, total, size := fetch(true)
+	if size != 300 {
+		t.Errorf("wrong body size, want: 300, got: %d", size)
+	}
+	if ttfb > 50*time.Millisecond {
+		t.Errorf("time to first byte too large, want < 50ms, got: %v", ttfb)
+	}
+	if total < 100*time.Millisecond {
+		t.Errorf("response streamed too quickly, want >= 100ms, got: %v", total)
+	}
+}
+
+func TestRecordWrites(t *testing.T) {
+	t.Parallel()
+
+	wt := &writeThrough{w: httptest.NewRecorder(), start: time.Now()}
+	w := wrapWriter(wt)
+	w.Write([]byte("abc"))
+	w.(http.Flusher).Flush()
+	w.(http.Flusher).Flush()
+	w.Write([]byte("de"))
+	for i := 0; i < maxWriteEvents; i++ {
+		w.Write([]byte("f"))
+	}
+
+	writes := wt.Writes()
+	if got := len(writes); got != maxWriteEvents {
+		t.Fatalf("wrong number of writes, want: %d, got: %d", maxWriteEvents, got)
+	}
+	if !writes[0].Flush || writes[0].Size != 3 {
+		t.Errorf("wrong first write: %+v", writes[0])
+	}
+	if !writes[1].Flush || writes[1].Size != 0 {
+		t.Errorf("expected a flush only event, got: %+v", writes[1])
+	}
+
+	var total uint64
+	for _, e := range writes {
+		total += e.Size
+	}
+	if total != wt.Size() {
+		t.Errorf("write sizes don't add up, want: %d, got: %d", wt.Size(), total)
+	}
+}
+
+func TestScaleWrites(t *testing.T) {
+	t.Parallel()
+
+	writes := []WriteEvent{
+		{Offset: 10 * time.Millisecond, Size: 100, Flush: true},
+		{Offset: 20 * time.Millisecond, Size: 200},
+	}
+
+	got := scaleWrites(writes, 300, 601, 20, 40)
+	want := []WriteEvent{
+		{Offset: 20 * time.Millisecond, Size: 200, Flush: true},
+		{Offset: 40 * time.Millisecond, Size: 401},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	if got := scaleWrites(writes, 0, 100, 20, 40); got != nil {
+		t.Errorf("expected no writes without a template size, got: %v", got)
+	}
+}
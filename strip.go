@@ -0,0 +1,72 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"net/http"
+)
+
+// MarkerStripper is implemented by detectors that can remove the marker they
+// detect from a request, e.g. the header of HeaderDetector. Markers that are
+// part of the route or the body, like those of PathDetector and
+// JSONFieldDetector, can't be stripped.
+type MarkerStripper interface {
+	StripMarker(r *http.Request)
+}
+
+func stripMarkers(ds []Detector, r *http.Request) {
+	for _, d := range ds {
+		if s, ok := d.(MarkerStripper); ok {
+			s.StripMarker(r)
+		}
+	}
+}
+
+// WithMarkerStripping removes the detector's marker from every request in
+// HandleTrack once it has been checked, so that the real handler and any
+// upstream it proxies to can't tell which requests were chaff. Middleware
+// wrapping the tracker has already seen the marker, use StripMarkers to hide
+// it from access logs too.
+func WithMarkerStripping() Option {
+	return func(t *Tracker) {
+		t.stripMarkers = true
+	}
+}
+
+type chaffDecisionKey struct{}
+
+// StripMarkers checks whether a request is chaff using d, then removes d's
+// marker from every request, chaff or not, before calling next. Install it
+// outside of any logging middleware, so that logged requests look the same.
+//
+// Since the marker is gone, HandleTrack and Track further down the chain use
+// the decision made here instead of their own detector.
+func StripMarkers(d Detector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isChaff := d.IsChaff(r)
+		r = r.WithContext(context.WithValue(r.Context(), chaffDecisionKey{}, isChaff))
+		if s, ok := d.(MarkerStripper); ok {
+			s.StripMarker(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chaffDecision returns the decision made by StripMarkers, if any.
+func chaffDecision(r *http.Request) (bool, bool) {
+	isChaff, ok := r.Context().Value(chaffDecisionKey{}).(bool)
+	return isChaff, ok
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logLine mimics an access log: the request line, status and the names of the
+// request and response headers, whose values vary between requests anyway.
+func logLine(r *http.Request, status int, respHeader http.Header) string {
+	names := func(h http.Header) string {
+		var s []string
+		for k := range h {
+			s = append(s, k)
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("%s %s %s %d [%s] [%s]", r.Method, r.RequestURI, r.Proto, status, names(r.Header), names(respHeader))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func TestStripMarkers(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithMarkerStripping())
+	defer track.Close()
+
+	detector := AnyOf(HeaderDetector(Header), QueryDetector("chaff"), CookieDetector("chaff"))
+
+	var mu sync.Mutex
+	var lines []string
+	var upstream []string
+	logger := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, logLine(r, rec.status, w.Header()))
+		})
+	}
+	real := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstream = append(upstream, r.URL.RawQuery+" "+r.Header.Get("Cookie"))
+		mu.Unlock()
+		w.Header().Set("X-Request-Id", "abcdef")
+		w.Write([]byte("hello"))
+	})
+
+	srv := httptest.NewServer(StripMarkers(detector, logger(track.HandleTrack(detector, real))))
+	defer srv.Close()
+
+	send := func(query, cookie string, marked bool) {
+		t.Helper()
+		r, err := http.NewRequest("GET", srv.URL+"/api?"+query, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		r.Header.Set("Cookie", cookie)
+		if marked {
+			r.Header.Set(Header, "1")
+		}
+		resp, err := srv.Client().Do(r)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// Stripping keeps the order and escaping of the other parameters.
+	send("b=2&a=%2F1", "session=a", false)
+	waitForRecords(t, track, 1)
+	send("b=2&chaff=1&a=%2F1", "session=a; chaff=1", true)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got: %v", lines)
+	}
+	if lines[0] != lines[1] {
+		t.Errorf("chaff request logged differently\nreal:  %s\nchaff: %s", lines[0], lines[1])
+	}
+	if len(upstream) != 1 {
+		t.Errorf("chaff request reached the real handler: %v", upstream)
+	}
+}
+
+func TestMarkerStripping(t *testing.T) {
+	t.Parallel()
+
+	track := New(WithMarkerStripping())
+	defer track.Close()
+
+	var got http.Header
+	handler := track.HandleTrack(Not(HeaderDetector("X-Real")), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+
+	detector, err := NewHMACDetector(Header, time.Minute, []byte("key"))
+	if err != nil {
+		t.Fatalf("NewHMACDetector: %v", err)
+	}
+	handler = track.HandleTrack(detector, handler)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Real", "1")
+	r.Header.Set(Header, "decoy")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got == nil {
+		t.Fatalf("real handler was not called")
+	}
+	if v := got.Get(Header); v != "" {
+		t.Errorf("marker %s was not stripped, got: %q", Header, v)
+	}
+	if v := got.Get("X-Real"); v != "1" {
+		t.Errorf("header of a Not detector was stripped")
+	}
+}
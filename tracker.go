@@ -15,8 +15,10 @@
 package chaff
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,7 +30,12 @@ import (
 const (
 	Header          = "X-Chaff"
 	DefaultCapacity = 100
+	MaxCapacity     = 1000000
 	MaxRandomBytes  = 1000000
+
+	// maxPending bounds the number of recorded requests waiting to be added
+	// to the history.
+	maxPending = 1000
 )
 
 // Tracker represents the status of a latency and request size tracker.
@@ -43,33 +50,89 @@ const (
 // then some individual requests will be dropped.
 type Tracker struct {
 	mu           sync.RWMutex
-	buffer       []*request
-	size         int
+	all          *history
+	keyed        map[string]*history
+	keyFn        KeyFunc
+	slotFn       SlotFunc
+	now          func() time.Time
 	cap          int
-	pos          int
+	window       time.Duration
+	halfLife     time.Duration
 	ch           chan *request
 	done         chan struct{}
+	shutdown     chan struct{}
 	resp         Responder
 	maxLatencyMs uint64
+	strategy     ProfileStrategy
+	headerAllow  map[string]struct{}
+	headerDeny   map[string]struct{}
+	drainMax     int64
+	shapeMax     int
+	stripMarkers bool
+	hijacked     uint64
+	loadAware    bool
+	inflight     int64
+
+	snapshotPath    string
+	baselineProfile *Profile
+	baseline        *request
+
+	store        ProfileStore
+	replica      string
+	syncInterval time.Duration
+	fleet        *Summary
 }
 
 type request struct {
 	latencyMs  uint64
 	bodySize   uint64
 	headerSize uint64
+	statusCode int
+	headers    []headerField
+	padHeader  string
+	writes     []WriteEvent
+	encoding   string
+	body       []byte
+	shape      *jsonShape
+
+	// Size of the inbound request.
+	reqHeaderSize uint64
+	reqBodySize   uint64
+	reqReadMs     uint64
+
+	// load is the load bucket the request was handled in, 0 if unknown.
+	load uint8
+
+	key      string
+	recorded time.Time
 }
 
-func newRequest(start, end time.Time, headerSize, bodySize uint64) *request {
+func newRequest(key string, start, end time.Time, statusCode int, headerSize, bodySize uint64) *request {
 	return &request{
 		latencyMs:  uint64(end.Sub(start).Milliseconds()),
 		headerSize: headerSize,
 		bodySize:   bodySize,
+		statusCode: statusCode,
+		key:        key,
+		recorded:   end,
 	}
 }
 
-// New creates a new tracker with the `DefaultCapacity`.
+// New creates a new tracker with the `DefaultCapacity`. If the snapshot of
+// WithSnapshotFile can't be restored, the error is logged and the tracker
+// starts empty, use NewTracker to handle the error instead. It panics if the
+// options are invalid.
 func New(opts ...Option) *Tracker {
-	t, _ := NewTracker(&PlainResponder{}, DefaultCapacity, opts...)
+	t, err := NewTracker(&PlainResponder{}, DefaultCapacity, opts...)
+	var serr *snapshotFileError
+	if errors.As(err, &serr) {
+		// A corrupt snapshot shouldn't keep the service from starting.
+		log.Printf("error restoring chaff snapshot, starting empty: %v", err)
+		t, err = NewTracker(&PlainResponder{}, DefaultCapacity, append(opts, WithSnapshotFile(""))...)
+	}
+	if err != nil {
+		panic(err)
+	}
 	return t
 }
 
@@ -83,6 +146,51 @@ func WithMaxLatency(maxLatencyMs uint64) Option {
 	}
 }
 
+// WithWindow limits the history to requests recorded within the given
+// duration, e.g. the last 10 minutes. The capacity still bounds the number of
+// requests kept within the window. Older requests are evicted as new ones are
+// recorded and periodically, every sixteenth of the window.
+func WithWindow(d time.Duration) Option {
+	return func(t *Tracker) {
+		t.window = d
+	}
+}
+
+// WithHalfLife makes the profile decay exponentially instead of weighing all
+// requests in the history equally: a request counts half as much as one
+// recorded d later, for both the mean and the distribution. The profile
+// adapts smoothly to changes in traffic, without being dominated by a short
+// burst or dropping requests abruptly once they are evicted, since evicted
+// requests keep contributing with their decayed weight.
+//
+// The capacity and window still bound the requests kept for SampleStrategy
+// and for mimicking headers and body structure. SampleStrategy picks among
+// them with their decayed weight. Snapshots only carry the
+// requests within the capacity.
+func WithHalfLife(d time.Duration) Option {
+	return func(t *Tracker) {
+		t.halfLife = d
+	}
+}
+
+// WithProfileStrategy sets the strategy used to derive a chaff response
+// profile from the recorded requests. The default is MeanStrategy.
+func WithProfileStrategy(s ProfileStrategy) Option {
+	return func(t *Tracker) {
+		t.strategy = s
+	}
+}
+
+// WithKeyFunc keeps a separate profile for each key returned by fn, in
+// addition to the global profile. Chaff requests are answered using the
+// profile for their key, falling back to the global profile if no real
+// requests have been recorded for that key.
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(t *Tracker) {
+		t.keyFn = fn
+	}
+}
+
 // NewTracker creates a tracker with custom capacity.
 // Launches a goroutine to update the request metrics.
 // To shut this down, use the .Close() method.
@@ -90,8 +198,13 @@ func WithMaxLatency(maxLatencyMs uint64) Option {
 // the tracker will default to the "PlainResponder" which just writes the raw
 // chaff bytes.
 func NewTracker(resp Responder, cap int, opts ...Option) (*Tracker, error) {
-	if cap < 1 || cap > DefaultCapacity {
-		return nil, fmt.Errorf("cap must be 1 <= cap <= 100, got: %v", cap)
+	if cap < 1 || cap > MaxCapacity {
+		return nil, fmt.Errorf("cap must be 1 <= cap <= %v, got: %v", MaxCapacity, cap)
+	}
+
+	pending := cap
+	if pending > maxPending {
+		pending = maxPending
 	}
 
 	if resp == nil {
@@ -99,45 +212,104 @@ func NewTracker(resp Responder, cap int, opts ...Option) (*Tracker, error) {
 	}
 
 	t := &Tracker{
-		buffer:       make([]*request, 0, int(cap)),
-		size:         0,
+		keyed:        make(map[string]*history),
 		cap:          cap,
-		pos:          0,
-		ch:           make(chan *request, cap),
+		ch:           make(chan *request, pending),
 		done:         make(chan struct{}),
+		shutdown:     make(chan struct{}),
 		resp:         resp,
 		maxLatencyMs: 0,
+		strategy:     MeanStrategy,
+		headerAllow:  headerSet(DefaultHeaderAllowlist),
+		headerDeny:   make(map[string]struct{}),
+		now:          time.Now,
 	}
 
 	// Apply options.
 	for _, opt := range opts {
 		opt(t)
 	}
+	if t.store != nil && t.syncInterval <= 0 {
+		return nil, fmt.Errorf("profile store interval must be positive, got: %v", t.syncInterval)
+	}
+	t.all = t.newHistory()
+	if t.baselineProfile != nil {
+		t.baseline = t.baselineRequest(*t.baselineProfile)
+	}
+	if t.snapshotPath != "" {
+		if err := t.restoreFile(t.snapshotPath); err != nil {
+			return nil, err
+		}
+	}
 
 	go t.updater()
+	if t.store != nil {
+		go t.syncStore()
+	}
 	return t, nil
 }
 
-// recordRequest actually puts a request in the circular buffer.
+// recordRequest actually puts a request in the circular buffers.
 func (t *Tracker) recordRequest(record *request) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if t.size < t.cap {
-		t.buffer = append(t.buffer, record)
-		t.size++
-		return
+	t.all.add(record)
+
+	keys := make([]string, 0, 3)
+	if record.key != "" {
+		keys = append(keys, record.key)
 	}
-	// Working as a circular buffer, just overrite and move on.
-	t.buffer[t.pos] = record
-	t.pos = (t.pos + 1) % t.cap
+	if t.slotFn != nil {
+		slot := t.slotFn(record.recorded)
+		keys = append(keys, slotKey("", slot))
+		if record.key != "" {
+			keys = append(keys, slotKey(record.key, slot))
+		}
+	}
+	for _, key := range keys {
+		if h := t.keyedHistory(key); h != nil {
+			h.add(record)
+		}
+	}
+}
+
+// keyedHistory returns the history of key, creating it if there are fewer than
+// MaxKeys. Otherwise it returns nil. The caller must hold t.mu.
+func (t *Tracker) keyedHistory(key string) *history {
+	h, ok := t.keyed[key]
+	if !ok {
+		if len(t.keyed) >= MaxKeys {
+			return nil
+		}
+		h = t.newHistory()
+		t.keyed[key] = h
+	}
+	return h
 }
 
 // updater is the go routine that is launched to pull requst details from
 // the request channel.
 func (t *Tracker) updater() {
+	// Entries outside of the window are evicted as new requests are recorded
+	// and, so that the profile doesn't go stale when traffic stops,
+	// periodically.
+	var expire <-chan time.Time
+	if t.window > 0 {
+		ticker := time.NewTicker(expireInterval(t.window))
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+
 	for {
 		select {
+		case <-expire:
+			t.expire(t.now())
 		case record := <-t.ch:
+			// Parse outside of the lock, only the structure is kept.
+			if record.body != nil {
+				record.shape, _ = parseJSONShape(record.body)
+				record.body = nil
+			}
 			t.recordRequest(record)
 		case <-t.done:
 			return
@@ -145,41 +317,138 @@ func (t *Tracker) updater() {
 	}
 }
 
+// expireInterval returns how often entries outside of the window are evicted.
+func expireInterval(window time.Duration) time.Duration {
+	d := window / 16
+	if d < 10*time.Millisecond {
+		d = 10 * time.Millisecond
+	}
+	return d
+}
+
+// expire evicts the entries that are outside of the window as of now and
+// forgets keys without entries.
+func (t *Tracker) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.all.expire(now)
+	for key, h := range t.keyed {
+		if h.expire(now); h.count() == 0 {
+			delete(t.keyed, key)
+		}
+	}
+}
+
 // Close will stop the updating goroutine and closes all channels.
+// Chaff responses that are waiting to normalize their latency return
+// immediately.
 func (t *Tracker) Close() {
+	close(t.shutdown)
 	t.done <- struct{}{}
 	close(t.ch)
 	close(t.done)
 }
 
-// CalculateProfile takes a read lock over the source data and
-// returns the current average latency and request sizes.
+// CalculateProfile takes a read lock over the source data and returns the
+// latency and sizes for the next chaff response, as determined by the
+// tracker's ProfileStrategy.
 func (t *Tracker) CalculateProfile() *request {
+	return t.calculateProfile("")
+}
+
+// calculateProfile returns the profile for the given key. If the key is empty
+// or no requests are recorded for it, the global profile is used.
+func (t *Tracker) calculateProfile(key string) *request {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	if t.size == 0 {
-		return &request{}
+	h := t.history(key)
+	fleet := t.fleetDistribution(key)
+	var profile *request
+	switch {
+	case h != nil:
+		profile = t.strategy.profile(h)
+		if fleet != nil {
+			latencyMs, headerSize, bodySize := t.strategy.draw(fleet)
+			profile.writes = scaleWrites(profile.writes, profile.bodySize, bodySize, profile.latencyMs, latencyMs)
+			profile.headers = headerTemplate(h.exemplars, headerSize)
+			profile.latencyMs, profile.headerSize, profile.bodySize = latencyMs, headerSize, bodySize
+		}
+		if t.loadAware {
+			t.conditionLoad(h, profile)
+		}
+		if len(paddableHeaders(profile.headers)) == 0 {
+			profile.padHeader = spareHeader(h.exemplars)
+		}
+	case fleet != nil:
+		profile = &request{}
+		profile.latencyMs, profile.headerSize, profile.bodySize = t.strategy.draw(fleet)
+	case t.baseline != nil:
+		baseline := *t.baseline
+		profile = &baseline
+	default:
+		return &request{statusCode: http.StatusOK}
 	}
 
-	var latency, hSize, bSize uint64
-	for _, r := range t.buffer {
-		latency += r.latencyMs
-		hSize += uint64(r.headerSize)
-		bSize += uint64(r.bodySize)
+	if profile.statusCode == 0 {
+		profile.statusCode = http.StatusOK
+	}
+	if max := t.maxLatencyMs; max > 0 && profile.latencyMs > max {
+		profile.writes = scaleWrites(profile.writes, profile.bodySize, profile.bodySize, profile.latencyMs, max)
+		profile.latencyMs = max
 	}
-	divisor := uint64(t.size)
+	return profile
+}
 
-	latencyMs := latency / divisor
-	if max := t.maxLatencyMs; max > 0 && latencyMs > max {
-		latencyMs = max
+// key returns the key of the request, or the empty string if the tracker
+// doesn't keep per-key profiles.
+func (t *Tracker) key(r *http.Request) string {
+	if t.keyFn == nil || r == nil {
+		return ""
 	}
+	return t.keyFn(r)
+}
 
-	return &request{
-		latencyMs:  latencyMs,
-		headerSize: uint64(hSize / divisor),
-		bodySize:   uint64(bSize / divisor),
+// newHistory creates a history with the tracker's settings.
+func (t *Tracker) newHistory() *history {
+	return newHistory(t.cap, t.window, t.halfLife)
+}
+
+// history returns the most specific history for the given key that has
+// requests within the window, see profileKeys, falling back to the history of
+// all recorded requests. Time slot histories also need minSlotEntries
+// requests. It returns nil if no history has requests. The caller must hold
+// t.mu.
+func (t *Tracker) history(key string) *history {
+	now := t.now()
+	for _, k := range t.profileKeys(key, now) {
+		h, ok := t.keyed[k]
+		if !ok || h.empty(now) || (k != key && h.count() < minSlotEntries) {
+			continue
+		}
+		return h
 	}
+	if t.all.empty(now) {
+		return nil
+	}
+	return t.all
+}
+
+// fleetDistribution is like history for the distributions pulled from the
+// profile store. It returns nil if there are none. The caller must hold t.mu.
+func (t *Tracker) fleetDistribution(key string) *Distribution {
+	if t.fleet == nil {
+		return nil
+	}
+	for _, k := range t.profileKeys(key, t.now()) {
+		d := t.fleet.Keys[k]
+		if d.empty() || (k != key && d.Latency.Count() < minSlotEntries) {
+			continue
+		}
+		return d
+	}
+	return t.fleet.distribution("")
 }
 
 // RandomData generates size bytes of random base64 data.
@@ -201,6 +470,12 @@ func RandomData(size uint64) string {
 	return base64.StdEncoding.EncodeToString(buffer)
 }
 
+// Hijacked returns the number of tracked requests whose handler hijacked the
+// connection. These requests are not part of the profile.
+func (t *Tracker) Hijacked() uint64 {
+	return atomic.LoadUint64(&t.hijacked)
+}
+
 // ServeHTTP implements http.Handler. See HandleChaff for more details.
 func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t.HandleChaff().ServeHTTP(w, r)
@@ -209,13 +484,48 @@ func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (t *Tracker) ChaffHandler(responder Responder) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		details := t.CalculateProfile()
+		t.drainBody(r.Context(), r)
+		details := t.calculateProfile(t.key(r))
+
+		// Mimic the real header set, the responder pads whatever remains.
+		headerSize := details.headerSize
+		added := writeHeaders(details.headers, w.Header())
+
+		// Encode the body like real responses, if the responder and client
+		// support it.
+		if er, ok := responder.(EncodingResponder); ok && details.encoding != "" {
+			if er.SupportsEncoding(details.encoding) && acceptsEncoding(r, details.encoding) {
+				w.Header().Set("Content-Encoding", details.encoding)
+				added += uint64(len("Content-Encoding") + len(details.encoding))
+			}
+		}
+
+		if added < headerSize {
+			headerSize -= added
+		} else {
+			headerSize = 0
+		}
 
-		if err := responder.Write(details.headerSize, details.bodySize, w, r); err != nil {
+		ctx := withHeaderPadding(r.Context(), &headerPadding{
+			names:    paddableHeaders(details.headers),
+			fallback: details.padHeader,
+		})
+		if details.shape != nil {
+			ctx = withJSONShape(ctx, details.shape)
+		}
+		r = r.WithContext(ctx)
+
+		var err error
+		if sr, ok := responder.(StreamResponder); ok && len(details.writes) > 0 {
+			err = sr.WriteStream(details.statusCode, headerSize, details.writes, w, r)
+		} else {
+			err = responder.Write(details.statusCode, headerSize, details.bodySize, w, r)
+		}
+		if err != nil {
 			log.Printf("error writing chaff response: %v", err)
 		}
 
-		t.normalizeLatnecy(start, details.latencyMs)
+		t.normalizeLatency(r.Context(), start, details.latencyMs)
 	})
 }
 
@@ -236,64 +546,88 @@ func (t *Tracker) Track(next http.Handler) http.Handler {
 // HandleTrack wraps the given http handler and detector. If the request is
 // deemed to be chaff (as determined by the Detector), the system sends a chaff
 // response. Otherwise it returns the real response and adds it to the tracker.
+//
+// If the request passed through StripMarkers, its decision is used instead of
+// the detector.
 func (t *Tracker) HandleTrack(d Detector, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if d != nil && d.IsChaff(r) {
+		isChaff, decided := chaffDecision(r)
+		if !decided {
+			isChaff = d != nil && d.IsChaff(r)
+		}
+		if s, ok := d.(MarkerStripper); ok && t.stripMarkers {
+			s.StripMarker(r)
+		}
+
+		if isChaff {
 			// Send chaff response
 			t.HandleChaff().ServeHTTP(w, r)
 			return
 		}
 
+		key := t.key(r)
+
 		// Handle the real request, gathering metadata
+		var body *countingBody
+		if r.Body != nil {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		var load uint8
+		if t.loadAware {
+			load = t.beginLoad()
+			defer t.endLoad()
+		}
 		start := time.Now()
-		proxyWriter := &writeThrough{w: w}
-		next.ServeHTTP(proxyWriter, r)
+		proxyWriter := &writeThrough{w: w, start: start, captureMax: t.shapeMax}
+		next.ServeHTTP(wrapWriter(proxyWriter), r)
 		end := time.Now()
 
+		// Hijacked connections, e.g. websockets, don't have a response that can
+		// be replayed.
+		if proxyWriter.Hijacked() {
+			atomic.AddUint64(&t.hijacked, 1)
+			return
+		}
+
 		// Grab the size of the headers that are present.
-		var headerSize uint64
-		for k, vals := range w.Header() {
-			headerSize += uint64(len(k))
-			for _, v := range vals {
-				headerSize += uint64(len(v))
-			}
+		record := newRequest(key, start, end, proxyWriter.StatusCode(), headerSize(w.Header()), proxyWriter.Size())
+		record.recorded = t.now()
+		record.load = load
+		record.headers = t.recordHeaders(w.Header())
+		record.writes = proxyWriter.Writes()
+		record.encoding = w.Header().Get("Content-Encoding")
+		record.body = proxyWriter.Body()
+		record.reqHeaderSize = headerSize(r.Header)
+		record.reqBodySize = requestBodySize(r, body)
+		if body != nil {
+			record.reqReadMs = uint64(body.ReadDuration(start).Milliseconds())
 		}
 
 		// Save metadata
 		select {
-		case t.ch <- newRequest(start, end, headerSize, proxyWriter.Size()):
+		case t.ch <- record:
 		default: // channel full, drop request.
 		}
 	})
 }
 
-func (t *Tracker) normalizeLatnecy(start time.Time, targetMs uint64) {
-	elapsed := time.Since(start)
-	if rem := targetMs - uint64(elapsed.Milliseconds()); rem > 0 {
-		time.Sleep(time.Duration(rem) * time.Millisecond)
+// normalizeLatency waits until targetMs have passed since start. It returns
+// early if the context is done, e.g. the client disconnected, or the tracker
+// is closed.
+func (t *Tracker) normalizeLatency(ctx context.Context, start time.Time, targetMs uint64) {
+	rem := time.Duration(targetMs)*time.Millisecond - time.Since(start)
+	if rem <= 0 {
+		return
 	}
-}
-
-// write through wraps an http.ResponseWriter so that we can count the number of
-// bytes that are written by the delegate handler.
-type writeThrough struct {
-	size uint64
-	w    http.ResponseWriter
-}
 
-func (wt *writeThrough) Header() http.Header {
-	return wt.w.Header()
-}
-
-func (wt *writeThrough) Write(b []byte) (int, error) {
-	atomic.AddUint64(&wt.size, uint64(len(b)))
-	return wt.w.Write(b)
-}
+	timer := time.NewTimer(rem)
+	defer timer.Stop()
 
-func (wt *writeThrough) WriteHeader(statusCode int) {
-	wt.w.WriteHeader(statusCode)
-}
-
-func (wt *writeThrough) Size() uint64 {
-	return atomic.LoadUint64(&wt.size)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-t.shutdown:
+	}
 }
@@ -15,6 +15,7 @@
 package chaff
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestRandomData(t *testing.T) {
@@ -62,8 +64,14 @@ func TestChaff(t *testing.T) {
 	track := New()
 	defer track.Close()
 
-	// Seed the tracker with a single request.
-	track.recordRequest(&request{25, 250, 100})
+	// Seed the tracker with a single request. Padding is added to the header
+	// with a random value.
+	track.recordRequest(&request{
+		latencyMs:  25,
+		bodySize:   250,
+		headerSize: 100,
+		headers:    []headerField{{name: "X-Request-Id", size: 20}},
+	})
 
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest("GET", "/", strings.NewReader(""))
@@ -83,10 +91,13 @@ func TestChaff(t *testing.T) {
 		t.Errorf("wrong code, want: %v, got: %v", http.StatusOK, w.Code)
 	}
 
-	if header := w.Header().Get(Header); header == "" {
-		t.Errorf("expected header '%v' missing", Header)
+	if header := w.Header().Get(Header); header != "" {
+		t.Errorf("unexpected header '%v' in chaff response", Header)
+	}
+	if header := w.Header().Get("X-Request-Id"); header == "" {
+		t.Errorf("expected header 'X-Request-Id' missing")
 	} else {
-		checkLength(t, 100, len(header))
+		checkLength(t, 100, len("X-Request-Id")+len(header))
 	}
 	checkLength(t, 250, len(w.Body.Bytes()))
 }
@@ -97,7 +108,7 @@ func TestTracking(t *testing.T) {
 	defer track.Close()
 
 	{
-		want := &request{}
+		want := &request{statusCode: http.StatusOK}
 		got := track.CalculateProfile()
 		if diff := cmp.Diff(want, got, cmp.AllowUnexported(request{})); diff != "" {
 			t.Errorf("mismatch (-want, +got):\n%s", diff)
@@ -129,8 +140,8 @@ func TestTracking(t *testing.T) {
 	// requests are fast enough that 1ms is reasonable.
 	// sum(101:200)/100 -> 150
 	// for header there is an extra 7 bytes for header name
-	want := &request{1, 150, 157}
-	if diff := cmp.Diff(want, got, cmp.AllowUnexported(request{})); diff != "" {
+	want := &request{latencyMs: 1, bodySize: 150, headerSize: 157, statusCode: http.StatusAccepted}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(request{}), cmpopts.IgnoreFields(request{}, "headers", "writes")); diff != "" {
 		t.Errorf("mismatch (-want, +got):\n%s", diff)
 	}
 }
@@ -163,7 +174,7 @@ func TestMax(t *testing.T) {
 			t.Helper()
 			wrapped.ServeHTTP(recorder, request)
 			if recorder.Code != http.StatusAccepted {
-				t.Fatalf("wrong error code: want: %v, got: %v", http.StatusAccepted, recorder.Code)
+				t.Errorf("wrong error code: want: %v, got: %v", http.StatusAccepted, recorder.Code)
 			}
 		}(t)
 	}
@@ -239,3 +250,60 @@ func TestJSONMiddleware(t *testing.T) {
 	}
 	t.Logf(string(dat))
 }
+
+func TestNormalizeLatency(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	t.Run("waits", func(t *testing.T) {
+		start := time.Now()
+		track.normalizeLatency(context.Background(), start, 25)
+		if d := time.Since(start); d < 25*time.Millisecond {
+			t.Errorf("not enough time passed, want >= 25ms, got: %v", d)
+		}
+	})
+
+	t.Run("already_elapsed", func(t *testing.T) {
+		// Previously this underflowed and slept for a very long time.
+		start := time.Now().Add(-time.Second)
+		before := time.Now()
+		track.normalizeLatency(context.Background(), start, 25)
+		if d := time.Since(before); d > 10*time.Millisecond {
+			t.Errorf("expected immediate return, took: %v", d)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		before := time.Now()
+		track.normalizeLatency(ctx, before, 10000)
+		if d := time.Since(before); d > time.Second {
+			t.Errorf("expected return on cancellation, took: %v", d)
+		}
+	})
+}
+
+func TestCloseInterruptsChaff(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	track.recordRequest(&request{latencyMs: 10000, statusCode: http.StatusOK})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		track.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	track.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("chaff request not interrupted by Close")
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikehelmick/go-chaff/internal/random"
+)
+
+// PaddingHeader carries the header padding of chaff requests sent by a
+// Transport with WithRequestToken, since the chaff Header carries the token.
+const PaddingHeader = "X-Chaff-Padding"
+
+type chaffContextKey struct{}
+
+// MarkChaff returns a shallow copy of r that the Transport will send as a
+// chaff request.
+func MarkChaff(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), chaffContextKey{}, true))
+}
+
+// IsMarkedChaff reports whether the request was marked with MarkChaff.
+func IsMarkedChaff(r *http.Request) bool {
+	v, _ := r.Context().Value(chaffContextKey{}).(bool)
+	return v
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// Transport is an http.RoundTripper that learns the size of real outgoing
+// requests and sends chaff requests that look like them.
+//
+// Requests marked with MarkChaff are tagged with the chaff Header, their body
+// and headers are padded to a size drawn from the recorded real requests, and
+// the response body is fully read and discarded before RoundTrip returns.
+// All other requests are sent unmodified and recorded.
+type Transport struct {
+	base     http.RoundTripper
+	mu       sync.Mutex
+	history  *history
+	strategy ProfileStrategy
+	sizeFn   func() RequestSize
+	tokenKey []byte
+}
+
+// TransportOption defines a method for applying options when configuring a
+// new transport.
+type TransportOption func(*Transport)
+
+// WithRequestStrategy sets the strategy used to derive the size of chaff
+// requests from the recorded real requests. The default is SampleStrategy.
+func WithRequestStrategy(s ProfileStrategy) TransportOption {
+	return func(t *Transport) {
+		t.strategy = s
+	}
+}
+
+// WithRequestProfile sizes chaff requests using fn instead of the sizes of
+// real requests sent through the transport, e.g. Tracker.RequestProfile of a
+// tracker that sees the same traffic on the server.
+func WithRequestProfile(fn func() RequestSize) TransportOption {
+	return func(t *Transport) {
+		t.sizeFn = fn
+	}
+}
+
+// WithRequestToken marks chaff requests with a token minted from key using
+// MintToken instead of a fixed header value, for servers using HMACDetector
+// with the same key. Header padding is carried in the PaddingHeader.
+func WithRequestToken(key []byte) TransportOption {
+	return func(t *Transport) {
+		t.tokenKey = key
+	}
+}
+
+// NewTransport creates a transport that remembers the last cap real requests.
+// If base is nil, http.DefaultTransport is used.
+func NewTransport(base http.RoundTripper, cap int, opts ...TransportOption) (*Transport, error) {
+	if cap < 1 || cap > MaxCapacity {
+		return nil, fmt.Errorf("cap must be 1 <= cap <= %v, got: %v", MaxCapacity, cap)
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	t := &Transport{
+		base:     base,
+		history:  newHistory(cap, 0, 0),
+		strategy: SampleStrategy,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !IsMarkedChaff(r) {
+		t.record(r)
+		return t.base.RoundTrip(r)
+	}
+
+	padded, err := t.pad(r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(padded)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the entire response, as a real caller would.
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return nil, fmt.Errorf("reading chaff response: %w", err)
+	}
+	resp.Body = http.NoBody
+	return resp, nil
+}
+
+// record saves the size of a real request. Requests with an unknown content
+// length are not recorded.
+func (t *Transport) record(r *http.Request) {
+	if r.ContentLength < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.history.add(&request{
+		headerSize: headerSize(r.Header),
+		bodySize:   uint64(r.ContentLength),
+		recorded:   time.Now(),
+	})
+}
+
+// pad returns a copy of the chaff request with its body and headers padded to
+// match a recorded real request.
+func (t *Transport) pad(r *http.Request) (*http.Request, error) {
+	profile := &request{}
+	if t.sizeFn != nil {
+		size := t.sizeFn()
+		profile.headerSize = size.HeaderSize
+		profile.bodySize = size.BodySize
+	} else {
+		t.mu.Lock()
+		if !t.history.empty(time.Now()) {
+			profile = t.strategy.profile(t.history)
+		}
+		t.mu.Unlock()
+	}
+
+	padded := r.Clone(r.Context())
+
+	if cl := r.ContentLength; profile.bodySize > 0 && (cl < 0 || uint64(cl) < profile.bodySize) {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		body := RandomData(profile.bodySize)
+		padded.Body = ioutil.NopCloser(strings.NewReader(body))
+		padded.ContentLength = int64(len(body))
+		padded.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(body)), nil
+		}
+	}
+
+	if t.tokenKey != nil {
+		token, err := MintToken(t.tokenKey, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("minting chaff token: %w", err)
+		}
+		padded.Header.Set(Header, token)
+		if size, want := headerSize(padded.Header)+uint64(len(PaddingHeader)), profile.headerSize; want > size {
+			padded.Header.Set(PaddingHeader, random.String(int(want-size)))
+		}
+		return padded, nil
+	}
+
+	// The chaff header's value carries the header padding.
+	value := "1"
+	if size, want := headerSize(padded.Header)+uint64(len(Header)), profile.headerSize; want > size+uint64(len(value)) {
+		value = random.String(int(want - size))
+	}
+	padded.Header.Set(Header, value)
+	return padded, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	type seen struct {
+		chaff      bool
+		bodySize   int
+		headerSize uint64
+	}
+	var mu sync.Mutex
+	var requests []seen
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading body: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, seen{
+			chaff:      r.Header.Get(Header) != "",
+			bodySize:   len(b),
+			headerSize: headerSize(r.Header),
+		})
+		mu.Unlock()
+		w.Write([]byte(strings.Repeat("r", 1000)))
+	}))
+	defer srv.Close()
+
+	transport, err := NewTransport(srv.Client().Transport, DefaultCapacity)
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	client := &http.Client{Transport: transport}
+
+	// A real request.
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader(strings.Repeat("a", 500)))
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", strings.Repeat("t", 200))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); len(b) != 1000 {
+		t.Errorf("real response body was modified, got %d bytes", len(b))
+	}
+	resp.Body.Close()
+
+	// A chaff request.
+	req, err = http.NewRequest("POST", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	resp, err = client.Do(MarkChaff(req))
+	if err != nil {
+		t.Fatalf("error sending chaff: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); len(b) != 0 {
+		t.Errorf("chaff response body was not discarded, got %d bytes", len(b))
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got: %d", len(requests))
+	}
+	realReq, chaffReq := requests[0], requests[1]
+	if realReq.chaff || !chaffReq.chaff {
+		t.Errorf("wrong chaff markers, real: %v chaff: %v", realReq.chaff, chaffReq.chaff)
+	}
+	checkLength(t, realReq.bodySize, chaffReq.bodySize)
+	if diff := int(chaffReq.headerSize) - int(realReq.headerSize); diff < -5 || diff > 5 {
+		t.Errorf("chaff header size not padded, want: ~%d, got: %d", realReq.headerSize, chaffReq.headerSize)
+	}
+}
+
+func TestTransportToken(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	detector, err := NewHMACDetector(Header, time.Minute, key)
+	if err != nil {
+		t.Fatalf("NewHMACDetector: %v", err)
+	}
+
+	var mu sync.Mutex
+	var sizes []uint64
+	var chaffSeen, realSeen int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, headerSize(r.Header))
+		if detector.IsChaff(r) {
+			chaffSeen++
+		} else {
+			realSeen++
+		}
+	}))
+	defer srv.Close()
+
+	transport, err := NewTransport(srv.Client().Transport, DefaultCapacity, WithRequestToken(key))
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	client := &http.Client{Transport: transport}
+
+	for _, chaff := range []bool{false, true} {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		if chaff {
+			req = MarkChaff(req)
+		} else {
+			req.Header.Set("Authorization", strings.Repeat("t", 200))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending request: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if realSeen != 1 || chaffSeen != 1 {
+		t.Errorf("wrong detection, want: 1 real and 1 chaff, got: %d real and %d chaff", realSeen, chaffSeen)
+	}
+	if diff := int(sizes[1]) - int(sizes[0]); diff < -5 || diff > 5 {
+		t.Errorf("chaff header size not padded, want: ~%d, got: %d", sizes[0], sizes[1])
+	}
+}
+
+func TestMarkChaff(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if IsMarkedChaff(r) {
+		t.Errorf("request should not be marked as chaff")
+	}
+	if !IsMarkedChaff(MarkChaff(r)) {
+		t.Errorf("request should be marked as chaff")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// drainChunkSize is the number of bytes read from a chaff request body
+// between pauses.
+const drainChunkSize = 32 * 1024
+
+// RequestSize describes the size of an inbound (upload) request.
+type RequestSize struct {
+	HeaderSize uint64
+	BodySize   uint64
+}
+
+// RequestProfile returns the header and body size of the next chaff request,
+// derived from recorded real requests using the tracker's ProfileStrategy.
+// Clients, or a Transport configured with WithRequestProfile, can use this to
+// pad chaff uploads.
+func (t *Tracker) RequestProfile() RequestSize {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	h := t.history("")
+	if h == nil {
+		return RequestSize{}
+	}
+	if t.strategy == SampleStrategy {
+		v, _ := h.sample()
+		return RequestSize{
+			HeaderSize: v.reqHeaderSize,
+			BodySize:   v.reqBodySize,
+		}
+	}
+	_, headerSize, bodySize := t.strategy.draw(h.req)
+	return RequestSize{
+		HeaderSize: headerSize,
+		BodySize:   bodySize,
+	}
+}
+
+// countingBody wraps a request body to count the bytes read by the handler
+// and when the last read happened.
+type countingBody struct {
+	io.ReadCloser
+	size     uint64
+	lastRead int64
+}
+
+func (c *countingBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	atomic.AddUint64(&c.size, uint64(n))
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *countingBody) Size() uint64 {
+	return atomic.LoadUint64(&c.size)
+}
+
+// ReadDuration returns the time from start until the last read of the body,
+// or zero if the body was never read.
+func (c *countingBody) ReadDuration(start time.Time) time.Duration {
+	last := atomic.LoadInt64(&c.lastRead)
+	if last == 0 {
+		return 0
+	}
+	return time.Unix(0, last).Sub(start)
+}
+
+// requestBodySize returns the size of the uploaded body. The declared content
+// length is used if known, since the handler may not have read the entire
+// body, otherwise the number of bytes the handler read.
+func requestBodySize(r *http.Request, body *countingBody) uint64 {
+	if r.ContentLength >= 0 {
+		return uint64(r.ContentLength)
+	}
+	if body == nil {
+		return 0
+	}
+	return body.Size()
+}
+
+// WithRequestDrain makes the chaff handler read and discard up to max bytes of
+// the chaff request body, at the rate real handlers read request bodies.
+// Otherwise the upload of a chaff request stalls once the network buffers are
+// full, which differs from a real upload that is fully consumed.
+func WithRequestDrain(max int64) Option {
+	return func(t *Tracker) {
+		t.drainMax = max
+	}
+}
+
+// readRate returns the rate, in bytes per millisecond, at which real handlers
+// read request bodies. Zero means no rate is known.
+func (t *Tracker) readRate(r *http.Request) float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	h := t.history(t.key(r))
+	if h == nil || h.readMs <= 0 {
+		return 0
+	}
+	return h.readBytes / h.readMs
+}
+
+// drainBody reads and discards up to t.drainMax bytes of the request body,
+// pacing reads to match the rate of real handlers.
+func (t *Tracker) drainBody(ctx context.Context, r *http.Request) {
+	if t.drainMax <= 0 || r.Body == nil {
+		return
+	}
+
+	rate := t.readRate(r)
+	start := time.Now()
+	var read int64
+	for read < t.drainMax {
+		chunk := int64(drainChunkSize)
+		if rem := t.drainMax - read; rem < chunk {
+			chunk = rem
+		}
+		n, err := io.CopyN(ioutil.Discard, r.Body, chunk)
+		read += n
+
+		if rate > 0 {
+			t.normalizeLatency(ctx, start, uint64(float64(read)/rate))
+		}
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+	}
+}
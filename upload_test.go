@@ -0,0 +1,148 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForRecords waits until the tracker has recorded n requests.
+func waitForRecords(t *testing.T, track *Tracker, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		track.mu.RLock()
+		size := track.all.count()
+		track.mu.RUnlock()
+		if size >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d records, got %d", n, size)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestProfile(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	if got := track.RequestProfile(); got != (RequestSize{}) {
+		t.Errorf("expected empty profile, got: %+v", got)
+	}
+
+	handler := track.Track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+
+	// Known content length.
+	r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 1000)))
+	r.Header = http.Header{"Authorization": []string{strings.Repeat("t", 87)}}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// Unknown content length, the bytes read by the handler are counted.
+	r = httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 3000))))
+	r.ContentLength = -1
+	r.Header = http.Header{"Authorization": []string{strings.Repeat("t", 287)}}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	waitForRecords(t, track, 2)
+
+	want := RequestSize{HeaderSize: 200, BodySize: 2000}
+	if got := track.RequestProfile(); got != want {
+		t.Errorf("wrong request profile, want: %+v, got: %+v", want, got)
+	}
+}
+
+func TestTransportRequestProfile(t *testing.T) {
+	t.Parallel()
+
+	var got int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = len(b)
+	}))
+	defer srv.Close()
+
+	transport, err := NewTransport(srv.Client().Transport, DefaultCapacity,
+		WithRequestProfile(func() RequestSize {
+			return RequestSize{BodySize: 800}
+		}))
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(MarkChaff(req))
+	if err != nil {
+		t.Fatalf("error sending chaff: %v", err)
+	}
+	resp.Body.Close()
+
+	checkLength(t, 800, got)
+}
+
+func TestRequestDrain(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		max  int64
+		want int
+	}{
+		{"disabled", 0, 0},
+		{"full", 1 << 20, 50000},
+		{"limited", 10000, 10000},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			track := New(WithRequestDrain(tc.max))
+			defer track.Close()
+
+			// Real handlers read 1000 bytes per millisecond.
+			track.recordRequest(&request{reqBodySize: 100000, reqReadMs: 100, statusCode: http.StatusOK})
+
+			body := &countingBody{ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 50000)))}
+			r := httptest.NewRequest("POST", "/", body)
+
+			start := time.Now()
+			track.ServeHTTP(httptest.NewRecorder(), r)
+			elapsed := time.Since(start)
+
+			if got := int(body.Size()); got != tc.want {
+				t.Errorf("wrong number of bytes drained, want: %d, got: %d", tc.want, got)
+			}
+			if min := time.Duration(tc.want/1000) * time.Millisecond; elapsed < min {
+				t.Errorf("drained too quickly, want >= %v, got: %v", min, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// write through wraps an http.ResponseWriter so that we can count the number of
+// bytes and record the status code that are written by the delegate handler.
+type writeThrough struct {
+	size   uint64
+	status int32
+	w      http.ResponseWriter
+
+	start    time.Time
+	mu       sync.Mutex
+	writes   []WriteEvent
+	hijacked int32
+
+	// Captures the body of JSON responses, up to captureMax bytes.
+	captureMax int
+	capture    []byte
+	truncated  bool
+}
+
+// wrapWriter returns a http.ResponseWriter that records to wt and implements
+// the same optional interfaces (http.Flusher, http.Hijacker, io.ReaderFrom) as
+// the underlying writer, so wrapped handlers can still use them.
+func wrapWriter(wt *writeThrough) http.ResponseWriter {
+	_, isFlusher := wt.w.(http.Flusher)
+	_, isHijacker := wt.w.(http.Hijacker)
+	_, isReaderFrom := wt.w.(io.ReaderFrom)
+
+	f := flushWriter{wt}
+	h := hijackWriter{wt}
+	rf := readFromWriter{wt}
+
+	switch {
+	case isFlusher && isHijacker && isReaderFrom:
+		return struct {
+			*writeThrough
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{wt, f, h, rf}
+	case isFlusher && isHijacker:
+		return struct {
+			*writeThrough
+			http.Flusher
+			http.Hijacker
+		}{wt, f, h}
+	case isFlusher && isReaderFrom:
+		return struct {
+			*writeThrough
+			http.Flusher
+			io.ReaderFrom
+		}{wt, f, rf}
+	case isHijacker && isReaderFrom:
+		return struct {
+			*writeThrough
+			http.Hijacker
+			io.ReaderFrom
+		}{wt, h, rf}
+	case isFlusher:
+		return struct {
+			*writeThrough
+			http.Flusher
+		}{wt, f}
+	case isHijacker:
+		return struct {
+			*writeThrough
+			http.Hijacker
+		}{wt, h}
+	case isReaderFrom:
+		return struct {
+			*writeThrough
+			io.ReaderFrom
+		}{wt, rf}
+	}
+	return wt
+}
+
+type flushWriter struct{ wt *writeThrough }
+
+func (f flushWriter) Flush() {
+	f.wt.recordFlush()
+	f.wt.w.(http.Flusher).Flush()
+}
+
+type hijackWriter struct{ wt *writeThrough }
+
+func (h hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.wt.w.(http.Hijacker).Hijack()
+	if err == nil {
+		atomic.StoreInt32(&h.wt.hijacked, 1)
+	}
+	return conn, rw, err
+}
+
+type readFromWriter struct{ wt *writeThrough }
+
+func (rf readFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	atomic.CompareAndSwapInt32(&rf.wt.status, 0, http.StatusOK)
+	// The body isn't available for capture.
+	rf.wt.truncated = true
+	n, err := rf.wt.w.(io.ReaderFrom).ReadFrom(src)
+	atomic.AddUint64(&rf.wt.size, uint64(n))
+	rf.wt.recordWrite(int(n))
+	return n, err
+}
+
+// Unwrap returns the underlying writer, for use by http.ResponseController.
+func (wt *writeThrough) Unwrap() http.ResponseWriter {
+	return wt.w
+}
+
+func (wt *writeThrough) Header() http.Header {
+	return wt.w.Header()
+}
+
+func (wt *writeThrough) Write(b []byte) (int, error) {
+	// An implicit WriteHeader(http.StatusOK) happens on the first write.
+	atomic.CompareAndSwapInt32(&wt.status, 0, http.StatusOK)
+	atomic.AddUint64(&wt.size, uint64(len(b)))
+	wt.recordWrite(len(b))
+	wt.captureBody(b)
+	return wt.w.Write(b)
+}
+
+func (wt *writeThrough) WriteHeader(statusCode int) {
+	// Informational responses, e.g. 103 Early Hints, precede the final status.
+	// 101 Switching Protocols is final.
+	if statusCode >= 200 || statusCode == http.StatusSwitchingProtocols {
+		atomic.CompareAndSwapInt32(&wt.status, 0, int32(statusCode))
+	}
+	wt.w.WriteHeader(statusCode)
+}
+
+// StatusCode returns the status code sent by the delegate handler. If the
+// handler never wrote a response, net/http sends http.StatusOK.
+func (wt *writeThrough) StatusCode() int {
+	if s := atomic.LoadInt32(&wt.status); s != 0 {
+		return int(s)
+	}
+	return http.StatusOK
+}
+
+func (wt *writeThrough) Size() uint64 {
+	return atomic.LoadUint64(&wt.size)
+}
+
+// Hijacked reports whether the delegate handler took over the connection.
+func (wt *writeThrough) Hijacked() bool {
+	return atomic.LoadInt32(&wt.hijacked) == 1
+}
+
+// recordWrite records a write of n bytes.
+func (wt *writeThrough) recordWrite(n int) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	if len(wt.writes) >= maxWriteEvents {
+		wt.writes[len(wt.writes)-1].Size += uint64(n)
+		return
+	}
+	wt.writes = append(wt.writes, WriteEvent{
+		Offset: time.Since(wt.start),
+		Size:   uint64(n),
+	})
+}
+
+// recordFlush marks the last write as flushed.
+func (wt *writeThrough) recordFlush() {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+
+	if l := len(wt.writes); l > 0 && (!wt.writes[l-1].Flush || l >= maxWriteEvents) {
+		wt.writes[l-1].Flush = true
+		return
+	}
+	wt.writes = append(wt.writes, WriteEvent{
+		Offset: time.Since(wt.start),
+		Flush:  true,
+	})
+}
+
+// Writes returns the recorded writes.
+func (wt *writeThrough) Writes() []WriteEvent {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return wt.writes
+}
+
+// captureBody buffers unencoded JSON response bodies.
+func (wt *writeThrough) captureBody(b []byte) {
+	if wt.captureMax <= 0 || wt.truncated {
+		return
+	}
+	if wt.capture == nil {
+		h := wt.w.Header()
+		if h.Get("Content-Encoding") != "" || !isJSON(h.Get("Content-Type")) {
+			wt.truncated = true
+			return
+		}
+	}
+	if len(wt.capture)+len(b) > wt.captureMax {
+		wt.capture = nil
+		wt.truncated = true
+		return
+	}
+	wt.capture = append(wt.capture, b...)
+}
+
+// Body returns the captured body, or nil if the body wasn't captured in full.
+func (wt *writeThrough) Body() []byte {
+	if wt.truncated {
+		return nil
+	}
+	return wt.capture
+}
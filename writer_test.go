@@ -0,0 +1,162 @@
+// Copyright 2020 Mike Helmick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaff
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// minimalWriter only implements http.ResponseWriter.
+type minimalWriter struct {
+	header http.Header
+}
+
+func (m *minimalWriter) Header() http.Header         { return m.header }
+func (m *minimalWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (m *minimalWriter) WriteHeader(int)             {}
+
+type interfaces struct {
+	flusher, hijacker, readerFrom bool
+}
+
+func supported(w http.ResponseWriter) interfaces {
+	_, f := w.(http.Flusher)
+	_, h := w.(http.Hijacker)
+	_, rf := w.(io.ReaderFrom)
+	return interfaces{f, h, rf}
+}
+
+func TestWrapWriter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		w    http.ResponseWriter
+	}{
+		{"minimal", &minimalWriter{header: http.Header{}}},
+		{"recorder", httptest.NewRecorder()},
+	}
+	for _, tc := range cases {
+		wrapped := wrapWriter(&writeThrough{w: tc.w})
+		if want, got := supported(tc.w), supported(wrapped); want != got {
+			t.Errorf("%s: wrong interfaces, want: %+v, got: %+v", tc.name, want, got)
+		}
+		u, ok := wrapped.(interface{ Unwrap() http.ResponseWriter })
+		if !ok || u.Unwrap() != tc.w {
+			t.Errorf("%s: Unwrap doesn't return the underlying writer", tc.name)
+		}
+	}
+}
+
+func TestWrapServerWriter(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	srv := httptest.NewServer(track.Track(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got, want := supported(w), (interfaces{true, true, true}); got != want {
+				t.Errorf("wrong interfaces, want: %+v, got: %+v", want, got)
+			}
+			// Uses io.ReaderFrom.
+			io.Copy(w, strings.NewReader(strings.Repeat("a", 5000)))
+		})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	waitForRecords(t, track, 1)
+	if got := track.CalculateProfile().bodySize; got != 5000 {
+		t.Errorf("wrong body size, want: 5000, got: %d", got)
+	}
+}
+
+func TestHijackedNotRecorded(t *testing.T) {
+	t.Parallel()
+
+	track := New()
+	defer track.Close()
+
+	srv := httptest.NewServer(track.Track(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("error hijacking: %v", err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			rw.Flush()
+		})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Errorf("wrong body, want: ok, got: %q", b)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for track.Hijacked() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for hijacked request")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	track.mu.RLock()
+	defer track.mu.RUnlock()
+	if got := track.all.count(); got != 0 {
+		t.Errorf("hijacked request was recorded, got %d records", got)
+	}
+}
+
+func TestInformationalStatusNotRecorded(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		codes []int
+		want  int
+	}{
+		{[]int{http.StatusEarlyHints, http.StatusNotFound}, http.StatusNotFound},
+		{[]int{http.StatusContinue}, http.StatusOK},
+		{[]int{http.StatusSwitchingProtocols}, http.StatusSwitchingProtocols},
+	}
+	for _, tc := range cases {
+		wt := &writeThrough{w: &minimalWriter{header: http.Header{}}}
+		for _, code := range tc.codes {
+			wt.WriteHeader(code)
+		}
+		if got := wt.StatusCode(); got != tc.want {
+			t.Errorf("status after %v, want: %d, got: %d", tc.codes, tc.want, got)
+		}
+	}
+}